@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default circuit breaker values for data sources.
+var (
+	DefaultBreakerFailureThreshold = 5
+	DefaultBreakerCooldown         = time.Minute
+)
+
+var errCircuitOpen = errors.New("Circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var (
+	dataSourceUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_datasource_up",
+		Help: "Whether the last query against the data source succeeded",
+	}, []string{"data_source"})
+
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_datasource_circuit_breaker_state",
+		Help: "State of the circuit breaker of the data source (0 = closed, 1 = open, 2 = half-open)",
+	}, []string{"data_source"})
+)
+
+func init() {
+	prometheus.MustRegister(dataSourceUp, breakerStateGauge)
+}
+
+// CircuitBreaker is shared by all workers querying the same data source.
+// After a number of consecutive failures it opens and queries are skipped
+// until the cooldown has passed. Then a single query is let through as a
+// probe, closing the breaker on success and opening it again on failure.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// NewCircuitBreaker creates a closed circuit breaker for a data source.
+func NewCircuitBreaker(name string, c CircuitBreakerConfig) *CircuitBreaker {
+	b := &CircuitBreaker{
+		name:      name,
+		threshold: c.FailureThreshold,
+		cooldown:  c.Cooldown,
+		now:       time.Now,
+	}
+	if b.threshold == 0 {
+		b.threshold = DefaultBreakerFailureThreshold
+	}
+	if b.cooldown == 0 {
+		b.cooldown = DefaultBreakerCooldown
+	}
+	breakerStateGauge.WithLabelValues(name).Set(float64(breakerClosed))
+	return b
+}
+
+// NewCircuitBreakers creates a circuit breaker for every data source.
+func NewCircuitBreakers(dataSources map[string]DataSource) map[string]*CircuitBreaker {
+	breakers := make(map[string]*CircuitBreaker, len(dataSources))
+	for name, ds := range dataSources {
+		breakers[name] = NewCircuitBreaker(name, ds.CircuitBreaker)
+	}
+	return breakers
+}
+
+func (b *CircuitBreaker) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+	level.Info(logger).Log("msg", "Circuit breaker changed state", "data_source", b.name, "state", s)
+	b.state = s
+	breakerStateGauge.WithLabelValues(b.name).Set(float64(s))
+}
+
+// Allow reports whether a query may be executed. A nil breaker allows all
+// queries.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful query and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dataSourceUp.WithLabelValues(b.name).Set(1)
+	b.failures = 0
+	b.probing = false
+	b.setState(breakerClosed)
+}
+
+// Release gives up the probe slot of a query which was allowed but whose
+// outcome says nothing about the data source, e.g. because it was canceled
+// or the SQL statement is invalid.
+func (b *CircuitBreaker) Release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Failure records a failed query and opens the breaker when the threshold
+// is reached or the probe failed.
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dataSourceUp.WithLabelValues(b.name).Set(0)
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.probing = false
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
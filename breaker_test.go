@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker("test-ds", CircuitBreakerConfig{
+		FailureThreshold: 2,
+		Cooldown:         time.Minute,
+	})
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("Breaker opened before reaching the failure threshold")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Breaker did not open after reaching the failure threshold")
+	}
+
+	// After the cooldown a single probe is let through.
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("Breaker did not let a probe through after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("Breaker let more than one probe through")
+	}
+
+	// A failed probe opens the breaker again.
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Breaker did not open after a failed probe")
+	}
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("Breaker did not let a probe through after the cooldown")
+	}
+	b.Success()
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("Breaker did not close after a successful probe")
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker("release-ds", CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("Breaker did not let a probe through after the cooldown")
+	}
+	// A released probe lets another query probe.
+	b.Release()
+	if !b.Allow() {
+		t.Fatal("Breaker did not let a probe through after the release")
+	}
+	if b.Allow() {
+		t.Fatal("Breaker let more than one probe through")
+	}
+}
+
+func TestWorkerBreakerErrors(t *testing.T) {
+	status := http.StatusBadRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	b := NewCircuitBreaker("errors-ds", CircuitBreakerConfig{FailureThreshold: 1})
+	w := NewWorker(context.Background(), &Query{Name: "breaker_metric", Interval: 1, Timeout: DefaultTimeout}, &WorkerShared{
+		Limiter:  NewQueryLimiter(0, nil),
+		Deps:     NewDependencies(),
+		Services: NewServicePool(StrategyFailover, []ServiceEndpoint{{Name: "agent", URL: ts.URL}}, nil),
+	})
+	w.breaker = b
+
+	// An invalid query doesn't open the breaker.
+	if err := w.fetchRecords(); err == nil {
+		t.Fatal("Expected error for bad request")
+	}
+	if !b.Allow() {
+		t.Fatal("Breaker opened after a client error")
+	}
+
+	status = http.StatusInternalServerError
+	if err := w.fetchRecords(); err == nil {
+		t.Fatal("Expected error for server error")
+	}
+	if b.Allow() {
+		t.Fatal("Breaker did not open after a server error")
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *CircuitBreaker
+	b.Failure()
+	b.Success()
+	b.Release()
+	if !b.Allow() {
+		t.Fatal("A nil breaker must allow all queries")
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
 )
 
@@ -20,46 +23,143 @@ var (
 	DefaultInterval                     = time.Minute * 5
 	DefaultService                      = ""
 	DefaultQueriesFile                  = "queries.yml"
-	DefaultQueriesDir                   = ""
 	DefaultPort                         = 8080
 	DefaultConfFile                     = ""
 	DefaultTolerateInvalidQueryDirFiles = false
+	DefaultSQLFiles                     = false
+	DefaultWebConfigFile                = ""
+	DefaultOnce                         = false
+	DefaultOutput                       = "-"
+	DefaultRuntimeMetrics               = true
+	DefaultLogLevel                     = "info"
+	DefaultLogFormat                    = LogFormatLogfmt
 )
 
 // Config is the base data structure.
 type Config struct {
-	Defaults    DefaultsData          `yaml:"defaults"`
-	DataSources map[string]DataSource `yaml:"data-sources"`
+	Defaults             DefaultsData          `yaml:"defaults"`
+	DataSources          map[string]DataSource `yaml:"data-sources"`
+	MaxConcurrentQueries int                   `yaml:"max-concurrent-queries"`
+	Service              ServiceConfig         `yaml:"service"`
+	Services             []ServiceEndpoint     `yaml:"services"`
+	MaxSeries            int                   `yaml:"max-series"`
+	Outputs              OutputsConfig         `yaml:"outputs"`
+	Secrets              SecretsConfig         `yaml:"secrets"`
+	RedactPatterns       []string              `yaml:"redact-patterns"`
+	Templates            map[string]*Query     `yaml:"templates"`
 }
 
 // DefaultsData defines the possible default values to define.
 type DefaultsData struct {
-	DataSourceRef     string        `yaml:"data-source"`
-	QueryInterval     time.Duration `yaml:"query-interval"`
-	QueryTimeout      time.Duration `yaml:"query-timeout"`
-	QueryValueOnError string        `yaml:"query-value-on-error"`
+	DataSourceRef     string         `yaml:"data-source"`
+	QueryInterval     time.Duration  `yaml:"query-interval"`
+	QueryTimeout      time.Duration  `yaml:"query-timeout"`
+	QueryValueOnError string         `yaml:"query-value-on-error"`
+	QueryStartJitter  *time.Duration `yaml:"query-start-jitter"`
+	QueryBackoff      BackoffConfig  `yaml:"query-backoff"`
+}
+
+// BackoffConfig defines how failed queries are retried. Unset values are
+// inherited from the data source, the defaults and finally the built-in
+// backoff.
+type BackoffConfig struct {
+	Min    time.Duration `yaml:"min"`
+	Max    time.Duration `yaml:"max"`
+	Factor float64       `yaml:"factor"`
+	Jitter *bool         `yaml:"jitter"`
+	// Zero means no limit. Set to zero to lift an inherited limit.
+	MaxRetries *int `yaml:"max-retries"`
 }
 
 // DataSource is configuration a data source which must be supported by sql-agent.
 type DataSource struct {
-	Driver     string                 `yaml:"driver"`
-	Properties map[string]interface{} `yaml:"properties"`
+	Driver               string                 `yaml:"driver"`
+	Properties           map[string]interface{} `yaml:"properties"`
+	MaxConcurrentQueries int                    `yaml:"max-concurrent-queries"`
+	Backoff              BackoffConfig          `yaml:"backoff"`
+	CircuitBreaker       CircuitBreakerConfig   `yaml:"circuit-breaker"`
+	Services             []string               `yaml:"services"`
+}
+
+// CircuitBreakerConfig defines when queries against a data source are
+// skipped after consecutive failures.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failure-threshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
 }
 
 // Query defines a SQL statement and parameters as well as configuration for the monitoring behavior
 type Query struct {
-	Name          string
-	Help          string
+	Name           string
+	Help           string
+	DataSourceRef  string `yaml:"data-source"`
+	Driver         string
+	Connection     map[string]interface{}
+	SQL            string
+	SQLFile        string `yaml:"sql-file"`
+	Template       *bool
+	Params         map[string]interface{}
+	Interval       time.Duration
+	Timeout        time.Duration
+	DataField      string            `yaml:"data-field"`
+	SubMetrics     map[string]string `yaml:"sub-metrics"`
+	ValueOnError   string            `yaml:"value-on-error"`
+	StartJitter    *time.Duration    `yaml:"start-jitter"`
+	Backoff        BackoffConfig
+	DependsOn      []string `yaml:"depends-on"`
+	Thresholds     Thresholds
+	MaxRows        int `yaml:"max-rows"`
+	MaxSeries      int `yaml:"max-series"`
+	Type           string
+	ExemplarFields []string `yaml:"exemplar-fields"`
+	Groups         []string
+	Labels         map[string]string
+	Foreach        []QueryVariant
+	Extends        string
+
+	// Name of the query this query was expanded from.
+	metric string
+}
+
+// QueryVariant is one of the queries a query with foreach is expanded into.
+// Its params are merged with the params of the query and its labels tell
+// the results of the variants apart.
+type QueryVariant struct {
 	DataSourceRef string `yaml:"data-source"`
-	Driver        string
-	Connection    map[string]interface{}
-	SQL           string
 	Params        map[string]interface{}
-	Interval      time.Duration
-	Timeout       time.Duration
-	DataField     string            `yaml:"data-field"`
-	SubMetrics    map[string]string `yaml:"sub-metrics"`
-	ValueOnError  string            `yaml:"value-on-error"`
+	Labels        map[string]string
+}
+
+// metricName returns the name of the metrics of the query, which is shared
+// by all variants of a query.
+func (q *Query) metricName() string {
+	if q.metric != "" {
+		return q.metric
+	}
+	return q.Name
+}
+
+func (q *Query) isExemplarField(field string) bool {
+	for _, f := range q.ExemplarFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Thresholds define the bounds of a query result. When set an additional
+// status metric is exposed for each result.
+type Thresholds struct {
+	Warning  *Threshold
+	Critical *Threshold
+}
+
+// Threshold is exceeded when comparing the result with the value using the
+// operator is true, e.g. result > 100.
+type Threshold struct {
+	Operator string
+	Value    float64
 }
 
 // QueryList is a array or Queries
@@ -87,7 +187,64 @@ func appendDefaults(c *Config) {
 	}
 }
 
+// mergeBackoff fills the unset values of b with the values of parent.
+func mergeBackoff(b, parent BackoffConfig) BackoffConfig {
+	if b.Min == 0 {
+		b.Min = parent.Min
+	}
+	if b.Max == 0 {
+		b.Max = parent.Max
+	}
+	if b.Factor == 0 {
+		b.Factor = parent.Factor
+	}
+	if b.Jitter == nil {
+		b.Jitter = parent.Jitter
+	}
+	if b.MaxRetries == nil {
+		b.MaxRetries = parent.MaxRetries
+	}
+	return b
+}
+
+func validateBackoff(b BackoffConfig) error {
+	if b.Min < 0 || b.Max < 0 {
+		return errors.New("backoff durations must not be negative")
+	}
+	if b.Min != 0 && b.Max != 0 && b.Min > b.Max {
+		return errors.New("backoff min must not be greater than max")
+	}
+	if b.Factor != 0 && b.Factor < 1 {
+		return errors.New("backoff factor must be at least 1")
+	}
+	if b.MaxRetries != nil && *b.MaxRetries < 0 {
+		return errors.New("backoff max-retries must not be negative")
+	}
+	return nil
+}
+
 func validateConfig(c *Config) error {
+	if err := validateServiceConfig(c.Service); err != nil {
+		return err
+	}
+	if err := validateServices(c); err != nil {
+		return err
+	}
+	if err := validateOutputs(c.Outputs); err != nil {
+		return err
+	}
+	if err := validateSecrets(c.Secrets); err != nil {
+		return err
+	}
+	if err := validateRedactPatterns(c.RedactPatterns); err != nil {
+		return err
+	}
+	if err := validateTemplates(c.Templates); err != nil {
+		return err
+	}
+	if err := validateBackoff(c.Defaults.QueryBackoff); err != nil {
+		return fmt.Errorf("Invalid default query backoff: %s", err)
+	}
 	for name, ds := range c.DataSources {
 		if ds.Driver == "" {
 			return fmt.Errorf("Driver is not defined for data source [%s]", name)
@@ -95,6 +252,21 @@ func validateConfig(c *Config) error {
 		if len(ds.Properties) == 0 {
 			return fmt.Errorf("Properties are not defined for data source [%s]", name)
 		}
+		if ds.MaxConcurrentQueries < 0 {
+			return fmt.Errorf("Max concurrent queries must not be negative for data source [%s]", name)
+		}
+		if err := validateBackoff(ds.Backoff); err != nil {
+			return fmt.Errorf("Invalid backoff for data source [%s]: %s", name, err)
+		}
+		if ds.CircuitBreaker.FailureThreshold < 0 || ds.CircuitBreaker.Cooldown < 0 {
+			return fmt.Errorf("Circuit breaker values must not be negative for data source [%s]", name)
+		}
+	}
+	if c.MaxSeries < 0 {
+		return errors.New("Max series must not be negative")
+	}
+	if c.MaxConcurrentQueries < 0 {
+		return errors.New("Max concurrent queries must not be negative")
 	}
 
 	return nil
@@ -116,17 +288,60 @@ func validateQuery(q *Query) error {
 	if q.Interval == 0 {
 		return fmt.Errorf("Interval must be greater than zero for query [%s]", q.Name)
 	}
+	if q.StartJitter != nil && *q.StartJitter < 0 {
+		return fmt.Errorf("Start jitter must not be negative for query [%s]", q.Name)
+	}
+	if err := validateBackoff(q.Backoff); err != nil {
+		return fmt.Errorf("Invalid backoff for query [%s]: %s", q.Name, err)
+	}
+	if q.MaxRows < 0 {
+		return fmt.Errorf("Max rows must not be negative for query [%s]", q.Name)
+	}
+	if q.MaxSeries < 0 {
+		return fmt.Errorf("Max series must not be negative for query [%s]", q.Name)
+	}
+	if _, err := parseQueryTemplate(q); err != nil {
+		return fmt.Errorf("Invalid template for query [%s]: %s", q.Name, err)
+	}
+	if q.Type != "" && q.Type != TypeGauge && q.Type != TypeCounter {
+		return fmt.Errorf("Invalid type [%s] for query [%s]", q.Type, q.Name)
+	}
+	if len(q.ExemplarFields) > 0 && q.Type != TypeCounter {
+		return fmt.Errorf("Exemplar fields require type counter for query [%s]", q.Name)
+	}
+	if _, ok := q.SubMetrics[statusSuffix]; ok {
+		return fmt.Errorf("Sub-metric [%s] is reserved for the threshold status for query [%s]", statusSuffix, q.Name)
+	}
+	for k := range q.Labels {
+		if !model.LabelName(k).IsValid() {
+			return fmt.Errorf("Invalid label name [%s] for query [%s]", k, q.Name)
+		}
+	}
+	for _, t := range []*Threshold{q.Thresholds.Warning, q.Thresholds.Critical} {
+		if t != nil && !validOperator(t.Operator) {
+			return fmt.Errorf("Invalid threshold operator [%s] for query [%s]", t.Operator, q.Name)
+		}
+	}
 
 	return nil
 }
 
 func loadConfig(file string) (*Config, error) {
-	log.Printf("Load config from file [%s]", file)
+	level.Info(logger).Log("msg", "Loading config", "file", file)
 	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading config file: %s", err)
 	}
 
+	// The SQL of templates is kept as is, $ is common in SQL, e.g. $1.
+	// Environment variables can be used with the env function instead.
+	var raw struct {
+		Templates map[string]*struct{ SQL string }
+	}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("Error decoding config file: %s", err)
+	}
+
 	// Expand environment variables.
 	b = []byte(os.ExpandEnv(string(b)))
 
@@ -135,6 +350,19 @@ func loadConfig(file string) (*Config, error) {
 		return nil, fmt.Errorf("Error decoding config file: %s", err)
 	}
 
+	for name, t := range c.Templates {
+		if t == nil {
+			continue
+		}
+		t.Name = name
+		if r := raw.Templates[name]; r != nil {
+			t.SQL = r.SQL
+		}
+		if err := readSQLFile(t, filepath.Dir(file)); err != nil {
+			return nil, err
+		}
+	}
+
 	appendDefaults(&c)
 	if err := validateConfig(&c); err != nil {
 		return nil, err
@@ -144,99 +372,262 @@ func loadConfig(file string) (*Config, error) {
 }
 
 func loadQueryConfig(queriesFile string, config *Config) (QueryList, error) {
-	log.Printf("Load queries from file [%s]", queriesFile)
-	// Read queries for request body.
-	file, err := os.Open(queriesFile)
-	if err != nil {
-		return nil, fmt.Errorf("Error opening queries file: %s", err)
-	}
+	return loadQueries(queriesFile, nil, config, QueryDirOptions{})
+}
 
-	defer file.Close()
-	return decodeQueries(file, config)
+// QueriesFile is a queries file with a namespace. Queries files can also be
+// just the list of queries.
+type QueriesFile struct {
+	// Prefix of the names of the queries in the file.
+	Namespace string
+	Queries   []map[string]*Query
 }
 
-func decodeQueries(r io.Reader, config *Config) (QueryList, error) {
+// decodeQueries decodes the queries of a queries file. The paths of SQL
+// files are relative to dir.
+func decodeQueries(r io.Reader, dir string, config *Config) (QueryList, error) {
 	if config == nil {
 		return nil, errors.New("Bug! Config must not be nil")
 	}
 
 	queries := make(QueryList, 0)
-	parsedQueries := make([]map[string]*Query, 0)
 
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = yaml.Unmarshal(b, &parsedQueries); err != nil {
+	var file QueriesFile
+	var raw interface{}
+	if err = yaml.Unmarshal(b, &raw); err != nil {
 		return nil, err
 	}
+	if _, ok := raw.(map[interface{}]interface{}); ok {
+		if err = yaml.Unmarshal(b, &file); err == nil && len(file.Queries) == 0 {
+			err = errors.New("Queries file without queries")
+		}
+	} else {
+		err = yaml.Unmarshal(b, &file.Queries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.Namespace != "" && !model.IsValidMetricName(model.LabelValue(file.Namespace)) {
+		return nil, fmt.Errorf("Invalid namespace [%s]", file.Namespace)
+	}
 
-	for _, data := range parsedQueries {
-		for k, q := range data {
-			q.Name = k
-			if q.DataSourceRef == "" {
-				q.DataSourceRef = config.Defaults.DataSourceRef
-			}
-			if q.Driver == "" {
-				if q.DataSourceRef != "" && len(config.DataSources) > 0 {
-					var ds = config.DataSources[q.DataSourceRef]
-					q.Driver = ds.Driver
-					q.Connection = ds.Properties
+	// Names of the queries in the file, which are prefixed with the
+	// namespace in dependencies too.
+	names := make(map[string]bool)
+	for _, data := range file.Queries {
+		for k := range data {
+			names[k] = true
+		}
+	}
+
+	for _, data := range file.Queries {
+		for k, parsed := range data {
+			parsed.Name = namespaced(file.Namespace, k)
+			if file.Namespace != "" {
+				for i, dep := range parsed.DependsOn {
+					if names[dep] {
+						parsed.DependsOn[i] = namespaced(file.Namespace, dep)
+					}
 				}
 			}
-			if q.Interval == 0 {
-				q.Interval = config.Defaults.QueryInterval
-			}
-			if q.Timeout == 0 {
-				q.Timeout = config.Defaults.QueryTimeout
-			}
-			if q.ValueOnError == "" && config.Defaults.QueryValueOnError != "" {
-				q.ValueOnError = config.Defaults.QueryValueOnError
-			}
-			q.DataField = strings.ToLower(q.DataField)
-			if err := validateQuery(q); err != nil {
+			expanded, err := prepareQuery(parsed, dir, config)
+			if err != nil {
 				return nil, err
 			}
-
-			queries = append(queries, q)
+			queries = append(queries, expanded...)
 		}
 
 	}
 
+	expandVariantDependencies(queries)
+	// Dependencies can refer to queries in other files, these are checked
+	// once all queries are loaded.
+	if err := validateDependencies(queries, true); err != nil {
+		return nil, err
+	}
+
 	return queries, nil
 }
 
-func loadQueriesInDir(path string, config *Config, allowFileErrors bool) (QueryList, error) {
-	log.Printf("Load queries from directory [%s]", path)
-	queries := make(QueryList, 0)
-	files, err := ioutil.ReadDir(path)
+func namespaced(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "_" + name
+}
+
+// prepareQuery reads the SQL file of a parsed query, applies its template
+// and the defaults and returns the validated queries it expands into.
+func prepareQuery(q *Query, dir string, config *Config) (QueryList, error) {
+	if err := readSQLFile(q, dir); err != nil {
+		return nil, err
+	}
+	if err := extendQuery(q, config.Templates); err != nil {
+		return nil, err
+	}
+	queries, err := expandQuery(q)
 	if err != nil {
 		return nil, err
 	}
+	for _, e := range queries {
+		if err := applyQueryDefaults(e, config); err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
 
-	for _, f := range files {
-		fn := f.Name()
-		if strings.HasSuffix(fn, ".yml") {
-			fn := fmt.Sprintf("%s/%s", strings.TrimRight(path, "/"), fn)
-			log.Println("Loading", fn)
-			file, err := os.Open(fn)
-			if err != nil {
-				return nil, err
-			}
+// expandQuery returns the variants of a query with foreach or the query
+// itself. The variants are named after the query and their labels, e.g.
+// orders{tenant="acme"}.
+func expandQuery(q *Query) (QueryList, error) {
+	if len(q.Foreach) == 0 {
+		return QueryList{q}, nil
+	}
+
+	queries := make(QueryList, 0, len(q.Foreach))
+	names := make(map[string]bool, len(q.Foreach))
+	var keys string
+	for i, v := range q.Foreach {
+		if len(v.Labels) == 0 {
+			return nil, fmt.Errorf("Labels required for variant %d of query [%s]", i+1, q.Name)
+		}
+		// The variants share the metrics, which need the same label names.
+		if k := labelNames(v.Labels); i == 0 {
+			keys = k
+		} else if k != keys {
+			return nil, fmt.Errorf("Variant %d of query [%s] has the labels [%s] instead of [%s]", i+1, q.Name, k, keys)
+		}
 
-			q, err := decodeQueries(file, config)
-			file.Close()
+		e := *q
+		e.Foreach = nil
+		e.metric = q.Name
+		if v.DataSourceRef != "" {
+			e.DataSourceRef = v.DataSourceRef
+			e.Driver = ""
+			e.Connection = nil
+		}
+		e.Params = make(map[string]interface{}, len(q.Params)+len(v.Params))
+		for k, p := range q.Params {
+			e.Params[k] = p
+		}
+		for k, p := range v.Params {
+			e.Params[k] = p
+		}
+		e.Labels = make(map[string]string, len(q.Labels)+len(v.Labels))
+		for k, l := range q.Labels {
+			e.Labels[k] = l
+		}
+		for k, l := range v.Labels {
+			e.Labels[k] = l
+		}
+		e.ExemplarFields = append([]string{}, q.ExemplarFields...)
 
-			if err == nil {
-				queries = append(queries, q...)
-			} else if allowFileErrors {
-				log.Printf("Ignoring error loading %s. err=%v", fn, err)
-			} else {
-				return nil, err
-			}
+		e.Name = variantName(q.Name, v.Labels)
+		if names[e.Name] {
+			return nil, fmt.Errorf("Duplicate variant [%s] of query [%s]", e.Name, q.Name)
 		}
+		names[e.Name] = true
+		queries = append(queries, &e)
 	}
-
 	return queries, nil
 }
+
+// labelNames returns the sorted names of the labels separated by commas.
+func labelNames(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func variantName(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", k, labels[k])
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+// applyQueryDefaults fills in the values of a query which are not set from
+// the data source and the defaults of the config and validates it.
+func applyQueryDefaults(q *Query, config *Config) error {
+	if q.DataSourceRef == "" {
+		q.DataSourceRef = config.Defaults.DataSourceRef
+	}
+	if q.Driver == "" {
+		if q.DataSourceRef != "" && len(config.DataSources) > 0 {
+			var ds = config.DataSources[q.DataSourceRef]
+			q.Driver = ds.Driver
+			q.Connection = ds.Properties
+		}
+	}
+	if q.Interval == 0 {
+		q.Interval = config.Defaults.QueryInterval
+	}
+	if q.Timeout == 0 {
+		q.Timeout = config.Defaults.QueryTimeout
+	}
+	if q.ValueOnError == "" && config.Defaults.QueryValueOnError != "" {
+		q.ValueOnError = config.Defaults.QueryValueOnError
+	}
+	if q.StartJitter == nil {
+		q.StartJitter = config.Defaults.QueryStartJitter
+	}
+	if ds, ok := config.DataSources[q.DataSourceRef]; ok {
+		q.Backoff = mergeBackoff(q.Backoff, ds.Backoff)
+	}
+	q.Backoff = mergeBackoff(q.Backoff, config.Defaults.QueryBackoff)
+	q.DataField = strings.ToLower(q.DataField)
+	for i, f := range q.ExemplarFields {
+		q.ExemplarFields[i] = strings.ToLower(f)
+	}
+	return validateQuery(q)
+}
+
+// loadQueriesInDir loads the queries of the files in the directory and its
+// subdirectories.
+func loadQueriesInDir(path string, config *Config, opts QueryDirOptions) (QueryList, error) {
+	return loadQueries("", []string{path}, config, opts)
+}
+
+// loadQueries loads the queries of the queries file, if set, and of the
+// query directories. Query names must be unique across all files.
+func loadQueries(queriesFile string, dirs []string, config *Config, opts QueryDirOptions) (QueryList, error) {
+	if err := validateQueryDirOptions(opts); err != nil {
+		return nil, err
+	}
+
+	l := newQueryLoader(config, opts)
+	if queriesFile != "" {
+		if err := l.addFile(queriesFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range dirs {
+		if err := l.addDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.addSQLFiles(); err != nil {
+		return nil, err
+	}
+
+	expandVariantDependencies(l.queries)
+	if err := validateDependencies(l.queries, false); err != nil {
+		return nil, err
+	}
+	return l.queries, nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -268,7 +270,7 @@ func Test_loadNonExistingFiles(t *testing.T) {
 		return
 	}
 
-	_, err = loadQueriesInDir(file, newConfig(), false)
+	_, err = loadQueriesInDir(file, newConfig(), QueryDirOptions{})
 	if err == nil {
 		t.Errorf("No errors even if query directory [%s] does not exist!", file)
 		return
@@ -280,7 +282,7 @@ func Test_allowBrokenQueryFileInDir(t *testing.T) {
 	//stop good queries from running
 
 	//load a directory having one good and one bad query
-	q, err := loadQueriesInDir("test-resources/config-test/one-good-query", newConfig(), true)
+	q, err := loadQueriesInDir("test-resources/config-test/one-good-query", newConfig(), QueryDirOptions{AllowFileErrors: true})
 	//expect no error and 1 query
 	if err != nil {
 		t.Fatal(err)
@@ -325,3 +327,378 @@ func Test_expandEnvFile(t *testing.T) {
 		t.Errorf("loadConfig() = %v, want %v", got, want)
 	}
 }
+
+func Test_queryBackoff(t *testing.T) {
+	c, err := loadConfig("test-resources/config-test/backoff-config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := loadQueryConfig("test-resources/config-test/queries-backoff.yml", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jitter := false
+	five, one, unlimited := 5, 1, 0
+	want := map[string]BackoffConfig{
+		"query_backoff_inherited": {Min: 2 * time.Second, Max: 30 * time.Second, Factor: 3, Jitter: &jitter, MaxRetries: &five},
+		"query_backoff_override":  {Min: 5 * time.Second, Max: 30 * time.Second, Factor: 3, Jitter: &jitter, MaxRetries: &one},
+		"query_backoff_unlimited": {Min: 2 * time.Second, Max: 30 * time.Second, Factor: 3, Jitter: &jitter, MaxRetries: &unlimited},
+	}
+	for _, q := range queries {
+		if !reflect.DeepEqual(q.Backoff, want[q.Name]) {
+			t.Errorf("[%s] backoff = %+v, want %+v", q.Name, q.Backoff, want[q.Name])
+		}
+	}
+
+	if _, err := decodeQueries(strings.NewReader("- q:\n    sql: select 1\n    backoff:\n      min: 1m\n      max: 1s\n"), "", c); err == nil {
+		t.Error("Expected error for backoff min greater than max")
+	}
+}
+
+func Test_reservedSubMetric(t *testing.T) {
+	yml := "- q:\n    driver: mysql\n    sql: select 1\n    sub-metrics:\n      status: state\n"
+	if _, err := decodeQueries(strings.NewReader(yml), "", newConfig()); err == nil {
+		t.Error("Expected error for sub-metric named status")
+	}
+}
+
+func Test_queryForeach(t *testing.T) {
+	c, err := loadConfig("test-resources/config-test/datasource-two.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := loadQueryConfig("test-resources/config-test/queries-foreach.yml", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 3 {
+		t.Fatalf("Expected 3 queries, got %d", len(queries))
+	}
+
+	acme, globex := queries[0], queries[1]
+	// A dependency on the query depends on all of its variants.
+	if want := []string{acme.Name, globex.Name}; !reflect.DeepEqual(queries[2].DependsOn, want) {
+		t.Errorf("Dependencies = %v, want %v", queries[2].DependsOn, want)
+	}
+	if acme.Name != `tenant_orders{tenant="acme"}` || globex.Name != `tenant_orders{tenant="globex"}` {
+		t.Errorf("Names = %s, %s", acme.Name, globex.Name)
+	}
+	if acme.metricName() != "tenant_orders" || globex.metricName() != "tenant_orders" {
+		t.Errorf("Metric names = %s, %s", acme.metricName(), globex.metricName())
+	}
+	if want := map[string]interface{}{"tenant_id": 1, "status": "open"}; !reflect.DeepEqual(acme.Params, want) {
+		t.Errorf("acme params = %v, want %v", acme.Params, want)
+	}
+	if want := map[string]interface{}{"tenant_id": 2, "status": "closed"}; !reflect.DeepEqual(globex.Params, want) {
+		t.Errorf("globex params = %v, want %v", globex.Params, want)
+	}
+	if want := map[string]string{"env": "prod", "tenant": "globex"}; !reflect.DeepEqual(globex.Labels, want) {
+		t.Errorf("globex labels = %v, want %v", globex.Labels, want)
+	}
+	if acme.Driver != "mysql" || globex.Driver != "mysql-2" {
+		t.Errorf("Drivers = %s, %s", acme.Driver, globex.Driver)
+	}
+
+	for _, yml := range []string{
+		"- q:\n    driver: mysql\n    sql: select 1\n    foreach:\n      - params:\n          id: 1\n",
+		"- q:\n    driver: mysql\n    sql: select 1\n    foreach:\n      - labels:\n          id: a\n      - labels:\n          id: a\n",
+		"- q:\n    driver: mysql\n    sql: select 1\n    labels:\n      0id: a\n",
+		"- q:\n    driver: mysql\n    sql: select 1\n    foreach:\n      - labels:\n          tenant: a\n      - labels:\n          region: b\n",
+	} {
+		if _, err := decodeQueries(strings.NewReader(yml), "", c); err == nil {
+			t.Errorf("Expected error for %q", yml)
+		}
+	}
+}
+
+func Test_queryTemplates(t *testing.T) {
+	c, err := loadConfig("test-resources/config-test/templates-config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := loadQueryConfig("test-resources/config-test/queries-templates.yml", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 queries, got %d", len(queries))
+	}
+
+	open, closed := queries[0], queries[1]
+	if open.Driver != "mysql" || open.DataField != "cnt" || !strings.HasPrefix(open.SQL, "with tenant_orders") {
+		t.Errorf("Query not inherited: %+v", open)
+	}
+	if open.Interval != 10*time.Minute || closed.Interval != time.Hour {
+		t.Errorf("Intervals = %s, %s", open.Interval, closed.Interval)
+	}
+	if want := map[string]interface{}{"tenant_id": 1, "status": "open"}; !reflect.DeepEqual(open.Params, want) {
+		t.Errorf("Params = %v, want %v", open.Params, want)
+	}
+	if want := map[string]interface{}{"tenant_id": 1, "status": "closed"}; !reflect.DeepEqual(closed.Params, want) {
+		t.Errorf("Params = %v, want %v", closed.Params, want)
+	}
+	if want := map[string]string{"team": "support"}; !reflect.DeepEqual(closed.Labels, want) {
+		t.Errorf("Labels = %v, want %v", closed.Labels, want)
+	}
+	// Environment variables are not expanded in the SQL of templates.
+	if want := "select count(1) as cnt from orders where status = $1 and note <> '$total'"; c.Templates["positional"].SQL != want {
+		t.Errorf("SQL = %q, want %q", c.Templates["positional"].SQL, want)
+	}
+	if c.Templates["base"].Params["status"] != "open" || len(c.Templates["tenant"].Params) != 1 {
+		t.Error("Template was modified")
+	}
+
+	if _, err := decodeQueries(strings.NewReader("- q:\n    extends: missing\n"), "", c); err == nil {
+		t.Error("Expected error for unknown template")
+	}
+	cycle := map[string]*Query{"a": {Extends: "b"}, "b": {Extends: "a"}}
+	if err := validateTemplates(cycle); err == nil {
+		t.Error("Expected error for template cycle")
+	}
+}
+
+func Test_queryStartJitter(t *testing.T) {
+	c := newConfig()
+	jitter := 10 * time.Second
+	c.Defaults.QueryStartJitter = &jitter
+	queries, err := decodeQueries(strings.NewReader("- a:\n    driver: mysql\n    sql: select 1\n- b:\n    driver: mysql\n    sql: select 1\n    start-jitter: 0s\n"), "", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := queries[0].StartJitter; j == nil || *j != jitter {
+		t.Errorf("[a] start jitter = %v, want %s", j, jitter)
+	}
+	// Zero disables the default start jitter.
+	if j := queries[1].StartJitter; j == nil || *j != 0 {
+		t.Errorf("[b] start jitter = %v, want 0", j)
+	}
+
+	if _, err := decodeQueries(strings.NewReader("- q:\n    driver: mysql\n    sql: select 1\n    start-jitter: -1s\n"), "", c); err == nil {
+		t.Error("Expected error for negative start jitter")
+	}
+}
+
+func Test_inheritQuery(t *testing.T) {
+	retries, jitter, enabled := 3, time.Minute, true
+	tmpl := &Query{
+		Template:       &enabled,
+		Driver:         "mysql",
+		Connection:     map[string]interface{}{"host": "localhost"},
+		StartJitter:    &jitter,
+		Backoff:        BackoffConfig{Min: time.Second, MaxRetries: &retries},
+		DependsOn:      []string{"orders"},
+		Thresholds:     Thresholds{Warning: &Threshold{Operator: ">", Value: 10}},
+		MaxRows:        100,
+		MaxSeries:      1000,
+		ExemplarFields: []string{"trace_id"},
+		Foreach:        []QueryVariant{{Labels: map[string]string{"tenant": "acme"}}},
+	}
+
+	q := &Query{Name: "q", Backoff: BackoffConfig{Max: time.Minute}, MaxRows: 10}
+	inheritQuery(q, tmpl)
+	want := *tmpl
+	want.Name = "q"
+	want.Backoff = BackoffConfig{Min: time.Second, Max: time.Minute, MaxRetries: &retries}
+	want.MaxRows = 10
+	if !reflect.DeepEqual(q, &want) {
+		t.Errorf("Query = %+v, want %+v", q, &want)
+	}
+
+	// The driver isn't inherited by a query with a data source.
+	q = &Query{Name: "q", DataSourceRef: "sales"}
+	inheritQuery(q, tmpl)
+	if q.DataSourceRef != "sales" || q.Driver != "" || q.Connection != nil {
+		t.Errorf("Data source = %s, driver = %s, connection = %v", q.DataSourceRef, q.Driver, q.Connection)
+	}
+}
+
+func Test_queriesFileFlag(t *testing.T) {
+	parse := func(args ...string) (*flag.FlagSet, string, stringList) {
+		var (
+			queriesFile string
+			queryDirs   stringList
+		)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.StringVar(&queriesFile, "queries", DefaultQueriesFile, "")
+		fs.Var(&queryDirs, "queryDir", "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs, queriesFile, queryDirs
+	}
+
+	if fs, file, dirs := parse(); queriesFileFlag(fs, file, dirs) != DefaultQueriesFile {
+		t.Error("Expected the default queries file without query directories")
+	}
+	if fs, file, dirs := parse("-queryDir", "queries"); queriesFileFlag(fs, file, dirs) != "" {
+		t.Error("Expected no queries file with query directories")
+	}
+
+	// An explicit -queries is loaded even though it is the default.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("test-resources/config-test/sql-files"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	fs, file, dirs := parse("-queries", "queries.yml", "-queryDir", "../query-dirs/nested")
+	queries, err := loadQueries(queriesFileFlag(fs, file, dirs), dirs, newConfig(), QueryDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, q := range queries {
+		names = append(names, q.Name)
+	}
+	if want := []string{"orders", "dir_query_b", "dir_query_c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Queries = %v, want %v", names, want)
+	}
+}
+
+func Test_sqlFiles(t *testing.T) {
+	queries, err := loadQueriesInDir("test-resources/config-test/sql-files", newConfig(), QueryDirOptions{SQLFiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 queries, got %d", len(queries))
+	}
+
+	sql := map[string]string{
+		"orders":   "/* Orders of all tenants */\nselect count(1)\nfrom orders",
+		"products": "select category, count(1) as cnt\nfrom products\ngroup by category",
+	}
+	for _, q := range queries {
+		if q.SQL != sql[q.Name] {
+			t.Errorf("[%s] sql = %q, want %q", q.Name, q.SQL, sql[q.Name])
+		}
+		if q.Name == "products" && (q.Interval != time.Hour || q.DataField != "cnt") {
+			t.Errorf("Front matter not applied: %+v", q)
+		}
+	}
+
+	// SQL files are only loaded when enabled.
+	queries, err = loadQueriesInDir("test-resources/config-test/sql-files", newConfig(), QueryDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 {
+		t.Errorf("Expected 1 query, got %d", len(queries))
+	}
+
+	for _, sql := range []string{"select 1", "/* driver: mysql */ select 1", "/*--- driver: mysql", "/*--- sql: select 2 ---*/ select 1"} {
+		if _, err := decodeSQLQuery(strings.NewReader(sql), "q", newConfig()); err == nil {
+			t.Errorf("Expected error for %q", sql)
+		}
+	}
+	if _, err := decodeQueries(strings.NewReader("- q:\n    driver: mysql\n    sql: select 1\n    sql-file: q.sql\n"), "", newConfig()); err == nil {
+		t.Error("Expected error for sql and sql-file")
+	}
+}
+
+func Test_loadQueries(t *testing.T) {
+	dir := "test-resources/config-test/query-dirs"
+	names := func(queries QueryList) []string {
+		var n []string
+		for _, q := range queries {
+			n = append(n, q.Name)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		dirs  []string
+		opts  QueryDirOptions
+		want  []string
+		isErr bool
+	}{
+		{
+			name: "Recursive",
+			dirs: []string{dir},
+			opts: QueryDirOptions{Exclude: []string{"dup"}},
+			want: []string{"dir_query_a", "dir_query_b", "dir_query_c"},
+		},
+		{
+			name: "Exclude",
+			dirs: []string{dir},
+			opts: QueryDirOptions{Exclude: []string{"dup", "nested/skip"}},
+			want: []string{"dir_query_a", "dir_query_b"},
+		},
+		{
+			name: "Include",
+			dirs: []string{dir},
+			opts: QueryDirOptions{Include: []string{"*.yaml"}},
+			want: []string{"dir_query_b"},
+		},
+		{
+			name: "File and directories",
+			file: "test-resources/config-test/one-good-query/good.yml",
+			dirs: []string{dir + "/nested/skip", dir + "/dup"},
+			want: []string{"storage_used_tb", "dir_query_c", "dir_query_a"},
+		},
+		{
+			name:  "Duplicate",
+			dirs:  []string{dir},
+			isErr: true,
+		},
+		{
+			name:  "Invalid pattern",
+			dirs:  []string{dir},
+			opts:  QueryDirOptions{Exclude: []string{"["}},
+			isErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadQueries(tt.file, tt.dirs, newConfig(), tt.opts)
+			if (err != nil) != tt.isErr {
+				t.Fatalf("loadQueries() error = %v, isErr %v", err, tt.isErr)
+			}
+			if err == nil && !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("loadQueries() = %v, want %v", names(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_queryNamespaces(t *testing.T) {
+	queries, err := loadQueriesInDir("test-resources/config-test/namespaces", newConfig(), QueryDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*Query)
+	for _, q := range queries {
+		byName[q.Name] = q
+	}
+	for _, name := range []string{"team_a_orders", "team_a_open_orders", "team_b_orders"} {
+		if byName[name] == nil {
+			t.Errorf("Query [%s] not loaded", name)
+		}
+	}
+	if q := byName["team_a_open_orders"]; q != nil && !reflect.DeepEqual(q.DependsOn, []string{"team_a_orders"}) {
+		t.Errorf("Dependencies = %v", q.DependsOn)
+	}
+
+	if _, err := decodeQueries(strings.NewReader("namespace: 1-a\nqueries:\n  - q:\n      driver: mysql\n      sql: select 1\n"), "", newConfig()); err == nil {
+		t.Error("Expected error for invalid namespace")
+	}
+	// A mapping without queries is not a queries file, e.g. a misspelled key.
+	for _, yml := range []string{"namespace: sales\n", "namespace: sales\nqeuries:\n  - q:\n      driver: mysql\n      sql: select 1\n", "q:\n  driver: mysql\n  sql: select 1\n"} {
+		if _, err := decodeQueries(strings.NewReader(yml), "", newConfig()); err == nil {
+			t.Errorf("Expected error for %q", yml)
+		}
+	}
+
+	// Conflicts are reported with both files.
+	a, b := "test-resources/config-test/query-dirs/a.yml", "test-resources/config-test/query-dirs/dup/a.yml"
+	_, err = loadQueries(a, []string{"test-resources/config-test/query-dirs/dup"}, newConfig(), QueryDirOptions{})
+	if err == nil || !strings.Contains(err.Error(), a) || !strings.Contains(err.Error(), b) {
+		t.Errorf("Expected duplicate error with both files, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Types of the metrics exposed for a query.
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+// resultMetric is a single series of a query result.
+type resultMetric interface {
+	prometheus.Metric
+	prometheus.Collector
+	Set(float64)
+}
+
+// counterMetric is a series of a counter query. Unlike the counters of the
+// client library its value is set from the result set. It keeps the time
+// it was created, or last reset, and an optional exemplar.
+type counterMetric struct {
+	desc       *prometheus.Desc
+	labelPairs []*dto.LabelPair
+	key        string
+
+	mu       sync.Mutex
+	value    float64
+	created  time.Time
+	exemplar *dto.Exemplar
+}
+
+func newCounterMetric(name, help string, labels prometheus.Labels) *counterMetric {
+	desc := prometheus.NewDesc(name, help, nil, labels)
+	pairs := prometheus.MakeLabelPairs(desc, nil)
+	return &counterMetric{
+		desc:       desc,
+		labelPairs: pairs,
+		key:        seriesKey(name, pairs),
+	}
+}
+
+// Set sets the value of the counter. The created time is reset if the
+// value decreases, i.e. the counter was reset.
+func (c *counterMetric) Set(v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.created.IsZero() || v < c.value {
+		c.created = time.Now()
+		counterCreated.set(c.key, c.created)
+	}
+	c.value = v
+}
+
+// setExemplar attaches an exemplar with the labels and the current value.
+// No labels remove the exemplar.
+func (c *counterMetric) setExemplar(labels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(labels) == 0 {
+		c.exemplar = nil
+		return
+	}
+
+	e := &dto.Exemplar{
+		Value:     proto.Float64(c.value),
+		Timestamp: timestamppb.New(time.Now()),
+	}
+	for name, value := range labels {
+		e.Label = append(e.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(e.Label, func(i, j int) bool { return e.Label[i].GetName() < e.Label[j].GetName() })
+	c.exemplar = e
+}
+
+// forget drops the created time once the series is no longer exposed.
+func (c *counterMetric) forget() {
+	counterCreated.delete(c.key)
+}
+
+func (c *counterMetric) Desc() *prometheus.Desc {
+	return c.desc
+}
+
+func (c *counterMetric) Write(out *dto.Metric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out.Label = c.labelPairs
+	out.Counter = &dto.Counter{Value: proto.Float64(c.value), Exemplar: c.exemplar}
+	return nil
+}
+
+func (c *counterMetric) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *counterMetric) Collect(ch chan<- prometheus.Metric) {
+	ch <- c
+}
+
+// counterName returns the name of a counter, which ends with _total.
+func counterName(name string) string {
+	if strings.HasSuffix(name, "_total") {
+		return name
+	}
+	return name + "_total"
+}
+
+// seriesKey identifies a series by its name and labels.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		fmt.Fprintf(&b, "\xff%s\xff%s", l.GetName(), l.GetValue())
+	}
+	return b.String()
+}
+
+// createdTimes holds the created times of the counter series by series key,
+// since the metric families of the client library can't carry them.
+type createdTimes struct {
+	mu    sync.RWMutex
+	times map[string]time.Time
+}
+
+var counterCreated = &createdTimes{times: make(map[string]time.Time)}
+
+func (t *createdTimes) set(key string, created time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.times[key] = created
+}
+
+func (t *createdTimes) delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.times, key)
+}
+
+func (t *createdTimes) get(key string) (time.Time, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	created, ok := t.times[key]
+	return created, ok
+}
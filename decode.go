@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+)
+
+// Formats of the result sets returned by the SQL agent.
+const (
+	FormatJSON   = "json"
+	FormatLDJSON = "ldjson"
+)
+
+var formatMediaTypes = map[string]string{
+	FormatJSON:   "application/json",
+	FormatLDJSON: "application/x-ldjson",
+}
+
+// recordIterator returns the next record of a result set, or io.EOF once
+// all records have been read.
+type recordIterator func() (record, error)
+
+func (recs records) iterator() recordIterator {
+	i := 0
+	return func() (record, error) {
+		if i >= len(recs) {
+			return nil, io.EOF
+		}
+		i++
+		return recs[i-1], nil
+	}
+}
+
+// decodeRecords reads the records from a response body one at a time. The
+// format is taken from the content type, either a JSON array or one JSON
+// object per line (LD-JSON).
+func decodeRecords(body io.Reader, contentType string) (recordIterator, error) {
+	dec := json.NewDecoder(body)
+
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == formatMediaTypes[FormatLDJSON] {
+		return func() (record, error) {
+			var rec record
+			if err := dec.Decode(&rec); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}, nil
+	}
+
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	// An empty result set might be encoded as null.
+	if t == nil {
+		return records(nil).iterator(), nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return nil, fmt.Errorf("Expected JSON array, got %v", t)
+	}
+
+	return func() (record, error) {
+		if !dec.More() {
+			return nil, io.EOF
+		}
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}, nil
+}
+
+// limitRecords fails once more than max records are read. A max of zero
+// means unlimited.
+func limitRecords(next recordIterator, max int) recordIterator {
+	if max <= 0 {
+		return next
+	}
+	n := 0
+	return func() (record, error) {
+		rec, err := next()
+		if err != nil {
+			return nil, err
+		}
+		n++
+		if n > max {
+			return nil, fmt.Errorf("Query returned more than %d rows", max)
+		}
+		return rec, nil
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func readAll(next recordIterator) (records, error) {
+	var recs records
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestDecodeRecords(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        int
+	}{
+		{"json", `[{"value": 1}, {"value": 2}]`, "application/json", 2},
+		{"json-empty", `[]`, "application/json", 0},
+		{"json-null", `null`, "application/json", 0},
+		{"ldjson", "{\"value\": 1}\n{\"value\": 2}\n{\"value\": 3}\n", "application/x-ldjson; charset=utf-8", 3},
+		{"ldjson-empty", "", "application/x-ldjson", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, err := decodeRecords(strings.NewReader(tt.body), tt.contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs, err := readAll(next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recs) != tt.want {
+				t.Errorf("Got %d records, want %d", len(recs), tt.want)
+			}
+		})
+	}
+
+	if _, err := decodeRecords(strings.NewReader(`{"value": 1}`), "application/json"); err == nil {
+		t.Error("Expected error for JSON object")
+	}
+}
+
+func TestLimitRecords(t *testing.T) {
+	recs := records{{"value": 1}, {"value": 2}, {"value": 3}}
+
+	if got, err := readAll(limitRecords(recs.iterator(), 3)); err != nil || len(got) != 3 {
+		t.Errorf("Got %d records and error %v, want 3 records", len(got), err)
+	}
+	if _, err := readAll(limitRecords(recs.iterator(), 2)); err == nil {
+		t.Error("Expected error when exceeding max rows")
+	}
+	if got, err := readAll(limitRecords(recs.iterator(), 0)); err != nil || len(got) != 3 {
+		t.Errorf("Got %d records and error %v, want 3 records", len(got), err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	querySuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_query_success",
+		Help: "Whether the last execution of the query succeeded",
+	}, []string{"query"})
+
+	queryDependencyFailed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_query_dependency_failed",
+		Help: "Whether the last execution of the query was skipped because a dependency failed or did not run",
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(querySuccess, queryDependencyFailed)
+}
+
+// expandVariantDependencies replaces dependencies on a query with foreach
+// by dependencies on all of its variants.
+func expandVariantDependencies(queries QueryList) {
+	variants := make(map[string][]string)
+	for _, q := range queries {
+		if q.metric != "" {
+			variants[q.metric] = append(variants[q.metric], q.Name)
+		}
+	}
+	if len(variants) == 0 {
+		return
+	}
+
+	for _, q := range queries {
+		var (
+			deps     []string
+			expanded bool
+		)
+		for _, name := range q.DependsOn {
+			if v, ok := variants[name]; ok {
+				deps = append(deps, v...)
+				expanded = true
+			} else {
+				deps = append(deps, name)
+			}
+		}
+		// The variants of a query share the slice, it is replaced.
+		if expanded {
+			q.DependsOn = deps
+		}
+	}
+}
+
+// validateDependencies checks that queries don't depend on themselves
+// through a cycle. Unless allowUnknown is set, every dependency must refer
+// to a query in the list.
+func validateDependencies(queries QueryList, allowUnknown bool) error {
+	byName := make(map[string]*Query, len(queries))
+	for _, q := range queries {
+		byName[q.Name] = q
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(queries))
+
+	var visit func(q *Query, path []string) error
+	visit = func(q *Query, path []string) error {
+		switch state[q.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("Dependency cycle detected: %s", strings.Join(append(path, q.Name), " -> "))
+		}
+		state[q.Name] = visiting
+		for _, name := range q.DependsOn {
+			dep, ok := byName[name]
+			if !ok {
+				if allowUnknown {
+					continue
+				}
+				return fmt.Errorf("Query [%s] depends on unknown query [%s]", q.Name, name)
+			}
+			if err := visit(dep, append(path, q.Name)); err != nil {
+				return err
+			}
+		}
+		state[q.Name] = visited
+		return nil
+	}
+
+	for _, q := range queries {
+		if err := visit(q, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type queryRun struct {
+	seq int
+	ok  bool
+}
+
+// Dependencies tracks the executions of all queries so dependent queries
+// can wait for their dependencies. It is shared by all workers.
+type Dependencies struct {
+	mu      sync.Mutex
+	runs    map[string]queryRun
+	changed chan struct{}
+}
+
+// NewDependencies creates an empty dependency tracker.
+func NewDependencies() *Dependencies {
+	return &Dependencies{
+		runs:    make(map[string]queryRun),
+		changed: make(chan struct{}),
+	}
+}
+
+// Done records an execution of a query and wakes up waiting dependents.
+func (d *Dependencies) Done(name string, ok bool) {
+	if ok {
+		querySuccess.WithLabelValues(name).Set(1)
+	} else {
+		querySuccess.WithLabelValues(name).Set(0)
+	}
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.runs[name] = queryRun{seq: d.runs[name].seq + 1, ok: ok}
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Wait blocks until every dependency has been executed since the executions
+// recorded in seen, which is updated in place. It returns an error if a
+// dependency failed or did not run before the deadline.
+func (d *Dependencies) Wait(ctx context.Context, deps []string, seen map[string]int, deadline time.Time) error {
+	if d == nil {
+		return nil
+	}
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+
+	for {
+		d.mu.Lock()
+		var pending, failed []string
+		for _, name := range deps {
+			run := d.runs[name]
+			if run.seq <= seen[name] {
+				pending = append(pending, name)
+			} else if !run.ok {
+				failed = append(failed, name)
+			}
+		}
+		changed := d.changed
+		if len(pending) == 0 {
+			for _, name := range deps {
+				seen[name] = d.runs[name].seq
+			}
+		}
+		d.mu.Unlock()
+
+		if len(pending) == 0 {
+			if len(failed) > 0 {
+				return fmt.Errorf("Dependencies failed: %s", strings.Join(failed, ", "))
+			}
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return fmt.Errorf("Dependencies did not run: %s", strings.Join(pending, ", "))
+		case <-ctx.Done():
+			return errors.New("Execution was canceled")
+		}
+	}
+}
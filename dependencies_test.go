@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func Test_validateDependencies(t *testing.T) {
+	_, err := loadQueryConfig("test-resources/config-test/queries-dependency-cycle.yml", newConfig())
+	if err == nil {
+		t.Error("Expected error for dependency cycle")
+	}
+
+	queries := QueryList{
+		{Name: "refresh"},
+		{Name: "check", DependsOn: []string{"refresh", "other"}},
+	}
+	if err := validateDependencies(queries, true); err != nil {
+		t.Errorf("Unexpected error with unknown dependencies allowed: %s", err)
+	}
+	if err := validateDependencies(queries, false); err == nil {
+		t.Error("Expected error for unknown dependency")
+	}
+}
+
+func TestDependenciesWait(t *testing.T) {
+	d := NewDependencies()
+	deps := []string{"refresh"}
+	seen := make(map[string]int)
+
+	// The dependency has not run yet.
+	if err := d.Wait(context.Background(), deps, seen, time.Now().Add(10*time.Millisecond)); err == nil {
+		t.Fatal("Expected error for dependency which did not run")
+	}
+
+	go d.Done("refresh", true)
+	if err := d.Wait(context.Background(), deps, seen, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same execution is not used twice.
+	if err := d.Wait(context.Background(), deps, seen, time.Now().Add(10*time.Millisecond)); err == nil {
+		t.Fatal("Expected error for dependency which did not run again")
+	}
+
+	d.Done("refresh", false)
+	if err := d.Wait(context.Background(), deps, seen, time.Now().Add(time.Second)); err == nil {
+		t.Fatal("Expected error for failed dependency")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Strategies for selecting the SQL agent service of a query.
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "round-robin"
+)
+
+// EndpointRecheckInterval is the time after which a failed service is
+// tried again before other services.
+var EndpointRecheckInterval = 30 * time.Second
+
+// ServiceEndpoint is a named SQL agent service.
+type ServiceEndpoint struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+var (
+	serviceUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_service_up",
+		Help: "Whether the last request to the SQL agent service succeeded",
+	}, []string{"service"})
+
+	serviceFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_sql_service_failures_total",
+		Help: "Number of failed requests to the SQL agent service",
+	}, []string{"service"})
+)
+
+func init() {
+	prometheus.MustRegister(serviceUp, serviceFailures)
+}
+
+func validateServices(c *Config) error {
+	if c.Service.URL != "" && len(c.Services) > 0 {
+		return errors.New("Either service url or services can be defined")
+	}
+	names := make(map[string]bool, len(c.Services))
+	for _, s := range c.Services {
+		if s.Name == "" {
+			return errors.New("Service is not named")
+		}
+		if s.URL == "" {
+			return fmt.Errorf("URL is not defined for service [%s]", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("Service [%s] is defined more than once", s.Name)
+		}
+		names[s.Name] = true
+	}
+	switch c.Service.Strategy {
+	case "", StrategyFailover, StrategyRoundRobin:
+	default:
+		return fmt.Errorf("Invalid service strategy [%s]", c.Service.Strategy)
+	}
+	for name, ds := range c.DataSources {
+		for _, s := range ds.Services {
+			if !names[s] {
+				return fmt.Errorf("Data source [%s] refers to unknown service [%s]", name, s)
+			}
+		}
+	}
+	return nil
+}
+
+// endpoint tracks the health of a service.
+type endpoint struct {
+	ServiceEndpoint
+
+	mu       sync.Mutex
+	failedAt time.Time
+}
+
+func (e *endpoint) healthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failedAt.IsZero() || time.Since(e.failedAt) > EndpointRecheckInterval
+}
+
+// ServicePool selects the SQL agent services for the queries of each data
+// source and tracks their health. It is shared by all workers.
+type ServicePool struct {
+	strategy    string
+	endpoints   []*endpoint
+	dataSources map[string][]*endpoint
+	next        uint32
+}
+
+// NewServicePool creates a pool of services. Data sources without assigned
+// services use all of them.
+func NewServicePool(strategy string, services []ServiceEndpoint, dataSources map[string]DataSource) *ServicePool {
+	p := &ServicePool{
+		strategy:    strategy,
+		dataSources: make(map[string][]*endpoint),
+	}
+	byName := make(map[string]*endpoint, len(services))
+	for _, s := range services {
+		e := &endpoint{ServiceEndpoint: s}
+		p.endpoints = append(p.endpoints, e)
+		byName[s.Name] = e
+		serviceUp.WithLabelValues(s.Name).Set(1)
+	}
+	for name, ds := range dataSources {
+		for _, s := range ds.Services {
+			if e, ok := byName[s]; ok {
+				p.dataSources[name] = append(p.dataSources[name], e)
+			}
+		}
+	}
+	return p
+}
+
+// Select returns the services to try in order for a query against the
+// data source. Healthy services come first.
+func (p *ServicePool) Select(dataSource string) []*endpoint {
+	candidates, ok := p.dataSources[dataSource]
+	if !ok {
+		candidates = p.endpoints
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	start := 0
+	if p.strategy == StrategyRoundRobin {
+		start = int(atomic.AddUint32(&p.next, 1)-1) % len(candidates)
+	}
+
+	healthy := make([]*endpoint, 0, len(candidates))
+	var unhealthy []*endpoint
+	for i := range candidates {
+		e := candidates[(start+i)%len(candidates)]
+		if e.healthy() {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Report records the outcome of a request to a service.
+func (p *ServicePool) Report(e *endpoint, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err == nil {
+		if !e.failedAt.IsZero() {
+			level.Info(logger).Log("msg", "Service is available again", "service", e.Name)
+		}
+		e.failedAt = time.Time{}
+		serviceUp.WithLabelValues(e.Name).Set(1)
+		return
+	}
+	if e.failedAt.IsZero() {
+		level.Warn(logger).Log("msg", "Service failed", "service", e.Name, "err", err)
+	}
+	e.failedAt = time.Now()
+	serviceUp.WithLabelValues(e.Name).Set(0)
+	serviceFailures.WithLabelValues(e.Name).Inc()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func endpointNames(endpoints []*endpoint) []string {
+	names := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		names[i] = e.Name
+	}
+	return names
+}
+
+func TestServicePoolSelect(t *testing.T) {
+	services := []ServiceEndpoint{
+		{Name: "primary", URL: "http://primary"},
+		{Name: "secondary", URL: "http://secondary"},
+	}
+	dataSources := map[string]DataSource{
+		"pinned": {Services: []string{"secondary"}},
+	}
+
+	p := NewServicePool(StrategyFailover, services, dataSources)
+	if got := endpointNames(p.Select("other")); len(got) != 2 || got[0] != "primary" {
+		t.Errorf("Select() = %v, want primary first", got)
+	}
+	if got := endpointNames(p.Select("pinned")); len(got) != 1 || got[0] != "secondary" {
+		t.Errorf("Select() = %v, want only secondary", got)
+	}
+
+	// Failed services are tried last.
+	p.Report(p.endpoints[0], http.ErrHandlerTimeout)
+	if got := endpointNames(p.Select("other")); got[0] != "secondary" {
+		t.Errorf("Select() = %v, want secondary first", got)
+	}
+	p.Report(p.endpoints[0], nil)
+	if got := endpointNames(p.Select("other")); got[0] != "primary" {
+		t.Errorf("Select() = %v, want primary first", got)
+	}
+
+	p = NewServicePool(StrategyRoundRobin, services, nil)
+	first := endpointNames(p.Select(""))[0]
+	second := endpointNames(p.Select(""))[0]
+	if first == second {
+		t.Errorf("Round robin selected [%s] twice", first)
+	}
+}
+
+func TestWorkerFailover(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"value": 42}]`))
+	}))
+	defer secondary.Close()
+
+	q := &Query{Name: "failover_metric", Interval: DefaultInterval, Timeout: DefaultTimeout}
+	w := NewWorker(context.Background(), q, &WorkerShared{
+		Limiter: NewQueryLimiter(0, nil),
+		Deps:    NewDependencies(),
+		Services: NewServicePool(StrategyFailover, []ServiceEndpoint{
+			{Name: "primary", URL: primary.URL},
+			{Name: "secondary", URL: secondary.URL},
+		}, nil),
+	})
+
+	if err := w.fetchRecords(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.result.Result) != 1 {
+		t.Errorf("Expected one metric, got %d", len(w.result.Result))
+	}
+	if w.services.endpoints[0].healthy() {
+		t.Error("Expected primary to be marked unhealthy")
+	}
+}
+
+func TestValidateServices(t *testing.T) {
+	c := &Config{
+		Service:  ServiceConfig{URL: "http://agent"},
+		Services: []ServiceEndpoint{{Name: "primary", URL: "http://primary"}},
+	}
+	if err := validateServices(c); err == nil {
+		t.Error("Expected error for service url and services")
+	}
+	c.Service.URL = ""
+	if err := validateServices(c); err != nil {
+		t.Error(err)
+	}
+}
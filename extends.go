@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extendQuery fills in the values of a query which are not set from the
+// template it extends and from the templates that template extends. Params,
+// labels, sub-metrics and the backoff are merged, values of the query take
+// precedence.
+func extendQuery(q *Query, templates map[string]*Query) error {
+	path := []string{q.Name}
+	seen := make(map[string]bool)
+	for name := q.Extends; name != ""; {
+		path = append(path, name)
+		if seen[name] {
+			return fmt.Errorf("Template cycle detected: %s", strings.Join(path, " -> "))
+		}
+		seen[name] = true
+
+		t, ok := templates[name]
+		if !ok || t == nil {
+			return fmt.Errorf("Query [%s] extends unknown template [%s]", q.Name, name)
+		}
+		inheritQuery(q, t)
+		name = t.Extends
+	}
+	return nil
+}
+
+func inheritQuery(q, t *Query) {
+	if q.Help == "" {
+		q.Help = t.Help
+	}
+	// A query with a data source or a driver of its own doesn't inherit
+	// any of the template's.
+	if q.DataSourceRef == "" && q.Driver == "" {
+		q.DataSourceRef = t.DataSourceRef
+		q.Driver = t.Driver
+		q.Connection = t.Connection
+	}
+	if q.SQL == "" {
+		q.SQL = t.SQL
+	}
+	if q.Template == nil {
+		q.Template = t.Template
+	}
+	if q.Interval == 0 {
+		q.Interval = t.Interval
+	}
+	if q.Timeout == 0 {
+		q.Timeout = t.Timeout
+	}
+	if q.DataField == "" {
+		q.DataField = t.DataField
+	}
+	if q.ValueOnError == "" {
+		q.ValueOnError = t.ValueOnError
+	}
+	if q.StartJitter == nil {
+		q.StartJitter = t.StartJitter
+	}
+	if q.DependsOn == nil {
+		q.DependsOn = t.DependsOn
+	}
+	if q.Thresholds.Warning == nil && q.Thresholds.Critical == nil {
+		q.Thresholds = t.Thresholds
+	}
+	if q.MaxRows == 0 {
+		q.MaxRows = t.MaxRows
+	}
+	if q.MaxSeries == 0 {
+		q.MaxSeries = t.MaxSeries
+	}
+	if q.Type == "" {
+		q.Type = t.Type
+	}
+	if q.ExemplarFields == nil {
+		q.ExemplarFields = t.ExemplarFields
+	}
+	if q.Groups == nil {
+		q.Groups = t.Groups
+	}
+	if q.Foreach == nil {
+		q.Foreach = t.Foreach
+	}
+	q.Backoff = mergeBackoff(q.Backoff, t.Backoff)
+	q.Params = mergeParams(q.Params, t.Params)
+	q.Labels = mergeLabels(q.Labels, t.Labels)
+	q.SubMetrics = mergeLabels(q.SubMetrics, t.SubMetrics)
+}
+
+// mergeParams returns a new map with the values of parent and m, values of
+// m take precedence.
+func mergeParams(m, parent map[string]interface{}) map[string]interface{} {
+	if len(parent) == 0 {
+		return m
+	}
+	merged := make(map[string]interface{}, len(m)+len(parent))
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged
+}
+
+func mergeLabels(m, parent map[string]string) map[string]string {
+	if len(parent) == 0 {
+		return m
+	}
+	merged := make(map[string]string, len(m)+len(parent))
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged
+}
+
+// validateTemplates checks that the templates extended by the templates
+// exist and don't form a cycle.
+func validateTemplates(templates map[string]*Query) error {
+	for name, t := range templates {
+		if t == nil {
+			return fmt.Errorf("Template [%s] is empty", name)
+		}
+		path := []string{name}
+		seen := map[string]bool{name: true}
+		for next := t.Extends; next != ""; {
+			path = append(path, next)
+			if seen[next] {
+				return fmt.Errorf("Template cycle detected: %s", strings.Join(path, " -> "))
+			}
+			seen[next] = true
+			parent, ok := templates[next]
+			if !ok || parent == nil {
+				return fmt.Errorf("Template [%s] extends unknown template [%s]", path[len(path)-2], next)
+			}
+			next = parent.Extends
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// resultIndex holds the results of all queries so the metrics endpoint can
+// serve a subset of them.
+type resultIndex struct {
+	mu      sync.RWMutex
+	results []*QueryResult
+}
+
+func (i *resultIndex) add(r *QueryResult) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.results = append(i.results, r)
+}
+
+// gatherer returns a gatherer for the results of the queries with one of
+// the names or in one of the groups. The name of a query with foreach
+// selects all of its variants.
+func (i *resultIndex) gatherer(names, groups []string) prometheus.Gatherer {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var gatherers prometheus.Gatherers
+	for _, r := range i.results {
+		if containsAny(names, r.Query.Name, r.Query.metricName()) || containsAny(groups, r.Query.Groups...) {
+			gatherers = append(gatherers, r)
+		}
+	}
+	return gatherers
+}
+
+func containsAny(list []string, values ...string) bool {
+	for _, l := range list {
+		for _, v := range values {
+			if l == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterHandler serves only the results of the queries selected with the
+// name[] and group parameters. Requests without them get the metrics of
+// the gatherer.
+func filterHandler(results *resultIndex, g prometheus.Gatherer) http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		names, groups := params["name[]"], params["group"]
+		if len(names) == 0 && len(groups) == 0 {
+			serveMetrics(w, r, g)
+			return
+		}
+		serveMetrics(w, r, results.gatherer(names, groups))
+	}))
+}
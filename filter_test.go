@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+func TestFilterHandler(t *testing.T) {
+	index := &resultIndex{}
+	shared := &WorkerShared{Deps: NewDependencies(), Results: index}
+	for _, q := range []*Query{
+		{Name: "filter_a", Interval: DefaultInterval},
+		{Name: "filter_b", Interval: DefaultInterval, Groups: []string{"hourly"}},
+		{Name: "filter_c", Interval: DefaultInterval, Groups: []string{"hourly", "daily"}},
+	} {
+		// Workers add their results to the shared index.
+		w := NewWorker(context.Background(), q, shared)
+		if err := w.result.SetMetrics(records{{"value": 1}}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(index.results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(index.results))
+	}
+	h := filterHandler(index, prometheus.NewRegistry())
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"name[]=filter_a", []string{"filter_a"}},
+		{"name[]=filter_a&name[]=filter_b", []string{"filter_a", "filter_b"}},
+		{"group=hourly", []string{"filter_b", "filter_c"}},
+		{"name[]=filter_a&group=daily", []string{"filter_a", "filter_c"}},
+		{"group=unknown", nil},
+		// The gatherer of the handler is empty.
+		{"", nil},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?"+tt.query, nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+
+		for _, name := range []string{"filter_a", "filter_b", "filter_c"} {
+			want := containsAny(tt.want, name)
+			if got := strings.Contains(string(body), "query_result_"+name+" "); got != want {
+				t.Errorf("%s: contains %s = %v, want %v", tt.query, name, got, want)
+			}
+		}
+	}
+}
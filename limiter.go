@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	queriesQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_queries_queued",
+		Help: "Number of queries waiting for a free execution slot",
+	}, []string{"data_source"})
+
+	queriesRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_sql_queries_running",
+		Help: "Number of queries currently executed by the SQL agent",
+	}, []string{"data_source"})
+)
+
+func init() {
+	prometheus.MustRegister(queriesQueued, queriesRunning)
+}
+
+// semaphore is a counting semaphore, a nil semaphore never blocks.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// QueryLimiter limits the number of queries executed at the same time, both
+// in total and for each data source. It is shared by all workers.
+type QueryLimiter struct {
+	global      semaphore
+	dataSources map[string]semaphore
+}
+
+// NewQueryLimiter creates a limiter from the global limit and the limits
+// defined on the data sources. A limit of zero means unlimited.
+func NewQueryLimiter(max int, dataSources map[string]DataSource) *QueryLimiter {
+	l := &QueryLimiter{
+		global:      newSemaphore(max),
+		dataSources: make(map[string]semaphore),
+	}
+	for name, ds := range dataSources {
+		if s := newSemaphore(ds.MaxConcurrentQueries); s != nil {
+			l.dataSources[name] = s
+		}
+	}
+	return l
+}
+
+// Acquire blocks until the query is allowed to run or the context is done.
+// The returned function must be called once the query has finished.
+func (l *QueryLimiter) Acquire(ctx context.Context, q *Query) (func(), error) {
+	queued := queriesQueued.WithLabelValues(q.DataSourceRef)
+	queued.Inc()
+	defer queued.Dec()
+
+	ds := l.dataSources[q.DataSourceRef]
+	if err := ds.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.global.acquire(ctx); err != nil {
+		ds.release()
+		return nil, err
+	}
+
+	running := queriesRunning.WithLabelValues(q.DataSourceRef)
+	running.Inc()
+
+	return func() {
+		running.Dec()
+		l.global.release()
+		ds.release()
+	}, nil
+}
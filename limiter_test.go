@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestQueryLimiterDataSource(t *testing.T) {
+	l := NewQueryLimiter(0, map[string]DataSource{
+		"limited": {MaxConcurrentQueries: 1},
+	})
+	limited := &Query{Name: "limited", DataSourceRef: "limited"}
+	other := &Query{Name: "other", DataSourceRef: "other"}
+
+	release, err := l.Acquire(context.Background(), limited)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other data sources are not limited.
+	releaseOther, err := l.Acquire(context.Background(), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	// A second query for the limited data source waits for the first one.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, limited); err == nil {
+		t.Fatal("Expected second query to wait for a free slot")
+	}
+
+	release()
+	release, err = l.Acquire(context.Background(), limited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestQueryLimiterGlobal(t *testing.T) {
+	l := NewQueryLimiter(1, nil)
+
+	release, err := l.Acquire(context.Background(), &Query{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, &Query{Name: "b"}); err == nil {
+		t.Fatal("Expected second query to wait for a free slot")
+	}
+	release()
+}
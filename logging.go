@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Formats of the log output.
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+// logger is the logger of the exporter.
+var logger = mustNewLogger(os.Stderr, DefaultLogLevel, DefaultLogFormat)
+
+// newLogger creates a logger writing messages of at least the level to w
+// in the format. Secrets are masked in the messages.
+func newLogger(w io.Writer, lvl, format string) (log.Logger, error) {
+	var l log.Logger
+	switch format {
+	case LogFormatLogfmt:
+		l = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case LogFormatJSON:
+		l = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("Invalid log format [%s]", format)
+	}
+
+	var opt level.Option
+	switch lvl {
+	case "debug":
+		opt = level.AllowDebug()
+	case "info":
+		opt = level.AllowInfo()
+	case "warn":
+		opt = level.AllowWarn()
+	case "error":
+		opt = level.AllowError()
+	default:
+		return nil, fmt.Errorf("Invalid log level [%s]", lvl)
+	}
+
+	l = level.NewFilter(redactor.Logger(l), opt)
+	return log.With(l, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller), nil
+}
+
+func mustNewLogger(w io.Writer, lvl, format string) log.Logger {
+	l, err := newLogger(w, lvl, format)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// fatal logs the error and exits.
+func fatal(keyvals ...interface{}) {
+	level.Error(logger).Log(keyvals...)
+	os.Exit(1)
+}
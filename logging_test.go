@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log/level"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "info", LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level.Debug(l).Log("msg", "hidden")
+	level.Info(l).Log("msg", "Fetched records", "query", "q")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line, got %d: %s", len(lines), buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "info" || entry["query"] != "q" || entry["msg"] != "Fetched records" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+
+	if _, err := newLogger(&buf, "verbose", LogFormatLogfmt); err == nil {
+		t.Error("Expected error for invalid level")
+	}
+	if _, err := newLogger(&buf, "info", "xml"); err == nil {
+		t.Error("Expected error for invalid format")
+	}
+}
@@ -3,107 +3,249 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	stdlog "log"
+	"math/rand"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"golang.org/x/net/context"
-	"gopkg.in/tylerb/graceful.v1"
 )
 
 func main() {
-	log.Println("prometheus-sql starting up...")
+	rand.Seed(time.Now().UnixNano())
 	var (
 		host                         string
 		port                         int
 		service                      string
 		queriesFile                  string
-		queryDir                     string
+		queryDirs                    stringList
+		queryDirInclude              stringList
+		queryDirExclude              stringList
 		confFile                     string
 		tolerateInvalidQueryDirFiles bool
+		sqlFiles                     bool
+		webConfigFile                string
+		once                         bool
+		output                       string
+		runtimeMetrics               bool
+		logLevel                     string
+		logFormat                    string
 	)
 
 	flag.StringVar(&host, "host", DefaultHost, "Host of the service.")
 	flag.IntVar(&port, "port", DefaultPort, "Port of the service.")
 	flag.StringVar(&service, "service", DefaultService, "Query of SQL agent service.")
 	flag.StringVar(&queriesFile, "queries", DefaultQueriesFile, "Path to file containing queries.")
-	flag.StringVar(&queryDir, "queryDir", DefaultQueriesDir, "Path to directory containing queries.")
+	flag.Var(&queryDirs, "queryDir", "Path to directory containing queries. Can be given several times.")
+	flag.Var(&queryDirInclude, "queryDir.include", "Glob pattern of the files loaded from queryDir, *.yml and *.yaml by default. Can be given several times.")
+	flag.Var(&queryDirExclude, "queryDir.exclude", "Glob pattern of the files and directories skipped in queryDir. Can be given several times.")
 	flag.StringVar(&confFile, "config", DefaultConfFile, "Configuration file to define common data sources etc.")
 	flag.BoolVar(&tolerateInvalidQueryDirFiles, "lax", DefaultTolerateInvalidQueryDirFiles, "Tolerate invalid files in queryDir")
+	flag.BoolVar(&sqlFiles, "sql-files", DefaultSQLFiles, "Load *.sql files with a front matter in queryDir as queries")
+	flag.StringVar(&webConfigFile, "web.config.file", DefaultWebConfigFile, "Path to configuration file that can enable TLS or authentication.")
+	flag.BoolVar(&once, "once", DefaultOnce, "Run every query once, write the results to -output and exit.")
+	flag.StringVar(&output, "output", DefaultOutput, "File the results are written to with -once, - for stdout.")
+	flag.BoolVar(&runtimeMetrics, "runtime-metrics", DefaultRuntimeMetrics, "Expose Go runtime and process metrics.")
+	flag.StringVar(&logLevel, "log.level", DefaultLogLevel, "Only log messages with the given severity or above. One of: debug, info, warn, error")
+	flag.StringVar(&logFormat, "log.format", DefaultLogFormat, "Output format of log messages. One of: logfmt, json")
 
 	flag.Parse()
 
-	if service == "" {
+	l, err := newLogger(os.Stderr, logLevel, logFormat)
+	if err != nil {
 		flag.Usage()
-		log.Fatal("Error: URL to SQL Agent service required.")
+		fatal("err", err)
 	}
+	logger = l
+	// Messages of libraries using the standard logger.
+	stdlog.SetOutput(log.NewStdlibAdapter(logger))
+	level.Info(logger).Log("msg", "prometheus-sql starting up...")
 
-	if queriesFile == DefaultQueriesFile && queryDir != "" {
-		queriesFile = ""
-	}
-	if queriesFile != "" && queryDir != "" {
-		flag.Usage()
-		log.Fatal("Error: You can specify either -queries or -queryDir")
-	}
+	queriesFile = queriesFileFlag(flag.CommandLine, queriesFile, queryDirs)
 
 	var (
-		err     error
-		queries QueryList
-		config  *Config
+		queries   QueryList
+		config    *Config
+		webConfig *WebConfig
 	)
 	config = newConfig()
 	if confFile != "" {
 		config, err = loadConfig(confFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("err", err)
+		}
+	}
+
+	if err := redactor.SetPatterns(config.RedactPatterns); err != nil {
+		fatal("err", err)
+	}
+
+	if webConfigFile != "" {
+		webConfig, err = loadWebConfig(webConfigFile)
+		if err != nil {
+			fatal("err", err)
 		}
 	}
 
-	if queryDir != "" {
-		queries, err = loadQueriesInDir(queryDir, config, tolerateInvalidQueryDirFiles)
-	} else {
-		queries, err = loadQueryConfig(queriesFile, config)
+	// The -service flag takes precedence over the services in the config.
+	services := config.Services
+	if service == "" {
+		service = config.Service.URL
+	}
+	if service != "" {
+		services = []ServiceEndpoint{{Name: "default", URL: service}}
+	}
+	if len(services) == 0 {
+		flag.Usage()
+		fatal("msg", "URL to SQL Agent service required")
 	}
+
+	queries, err = loadQueries(queriesFile, queryDirs, config, QueryDirOptions{
+		Include:         queryDirInclude,
+		Exclude:         queryDirExclude,
+		SQLFiles:        sqlFiles,
+		AllowFileErrors: tolerateInvalidQueryDirFiles,
+	})
 	if err != nil {
-		log.Fatal(err)
+		fatal("err", err)
 	}
 
 	if len(queries) == 0 {
-		log.Fatal("No queries loaded!")
+		fatal("msg", "No queries loaded!")
+	}
+
+	secrets := NewSecrets(config.Secrets)
+	if err := resolveQuerySecrets(queries, secrets); err != nil {
+		fatal("err", err)
 	}
 
 	// Wait group of queries.
 	wg := new(sync.WaitGroup)
-	wg.Add(len(queries))
 
 	// Shared context. Close the cxt.Done channel to stop the workers.
 	ctx, cancel := context.WithCancel(context.Background())
 
-	type contextKey string
-	var w *Worker
-
 	mux := http.NewServeMux()
 
-	for _, q := range queries {
-		// Create a new worker and start it in its own goroutine.
-		w = NewWorker(ctx, q)
-		go w.Start(service, wg)
+	transport, err := NewServiceTransport(config.Service)
+	if err != nil {
+		fatal("err", err)
+	}
+
+	queryRegistry := prometheus.NewRegistry()
+	queryResults := &resultIndex{}
+
+	shared := &WorkerShared{
+		// Limits the number of queries executed at the same time.
+		Limiter: NewQueryLimiter(config.MaxConcurrentQueries, config.DataSources),
+		// Skips queries against data sources which are down.
+		Breakers: NewCircuitBreakers(config.DataSources),
+		// Lets dependent queries wait for their dependencies.
+		Deps: NewDependencies(),
+		// Sends the requests to the SQL agent.
+		Transport: transport,
+		// Selects the SQL agent for each query.
+		Services: NewServicePool(config.Service.Strategy, services, config.DataSources),
+		// Format of the result sets returned by the SQL agent.
+		Format: config.Service.Format,
+		// Limits the number of series of all queries.
+		Series: NewSeriesBudget(config.MaxSeries),
+		// Sends the results to the Pushgateway or a remote write endpoint.
+		Sinks: NewSinks(ctx, config.Outputs, wg),
+		// Resolves the secrets of the connections.
+		Secrets: secrets,
+		// Holds the metrics of the query results, the metrics of the
+		// exporter itself are kept in the default registry.
+		Registry: queryRegistry,
+		// Lets the metrics endpoints select the results of some queries.
+		Results: queryResults,
 	}
 
-	// Register the handler.
-	mux.Handle("/metrics", promhttp.Handler())
+	workers := make([]*Worker, len(queries))
+	for i, q := range queries {
+		workers[i] = NewWorker(ctx, q, shared)
+	}
+
+	if once {
+		failed, err := runOnce(workers, output)
+		// Lets the outputs send the remaining results.
+		cancel()
+		wg.Wait()
+		if err != nil {
+			fatal("err", err)
+		}
+		if failed > 0 {
+			fatal("msg", "Queries failed", "failed", failed, "total", len(workers))
+		}
+		return
+	}
+
+	for _, w := range workers {
+		// Start each worker in its own goroutine.
+		wg.Add(1)
+		go w.Start(wg)
+	}
+
+	// The default registry holds the metrics of the exporter itself.
+	if !runtimeMetrics {
+		prometheus.Unregister(collectors.NewGoCollector())
+		prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	// Register the handlers.
+	mux.Handle("/metrics", filterHandler(queryResults, prometheus.Gatherers{queryRegistry, prometheus.DefaultGatherer}))
+	mux.Handle("/metrics/queries", filterHandler(queryResults, queryRegistry))
+	mux.Handle("/metrics/self", metricsHandler(prometheus.DefaultGatherer))
 
 	addr := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("* Listening on %s...", addr)
+	level.Info(logger).Log("msg", "Listening", "address", addr)
 
 	// Handles OS kill and interrupt.
-	graceful.Run(addr, 5*time.Second, mux)
+	if err := serveWeb(addr, mux, webConfig); err != nil {
+		fatal("err", err)
+	}
 
-	log.Print("Canceling workers")
+	level.Info(logger).Log("msg", "Canceling workers")
 	cancel()
-	log.Print("Waiting for workers to finish")
+	level.Info(logger).Log("msg", "Waiting for workers to finish")
 	wg.Wait()
-	log.Println("All workers have finished, exiting!")
+	level.Info(logger).Log("msg", "All workers have finished, exiting!")
+}
+
+// queriesFileFlag returns the queries file to load. The default queries file
+// is only used without query directories, a queries file given with -queries
+// is always loaded.
+func queriesFileFlag(fs *flag.FlagSet, queriesFile string, queryDirs []string) string {
+	if len(queryDirs) == 0 {
+		return queriesFile
+	}
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "queries" {
+			set = true
+		}
+	})
+	if !set {
+		return ""
+	}
+	return queriesFile
+}
+
+// stringList is a flag which can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
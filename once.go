@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runOnce executes every query once and writes the results in the text
+// exposition format to output. It returns the number of failed queries.
+// Failed queries are not retried so runs from cron don't hang.
+func runOnce(workers []*Worker, output string) (int, error) {
+	var (
+		wg     sync.WaitGroup
+		failed int32
+	)
+	// Queries run concurrently so dependent queries can wait for their
+	// dependencies.
+	for _, w := range workers {
+		w.noRetries = true
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			if err := w.Run(); err != nil {
+				level.Error(w.log).Log("msg", "Error fetching records", "err", err)
+				atomic.AddInt32(&failed, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(querySuccess); err != nil {
+		return 0, err
+	}
+	for _, w := range workers {
+		for _, m := range w.result.Result {
+			if err := reg.Register(m); err != nil {
+				return 0, err
+			}
+		}
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(failed), writeTextfile(output, families)
+}
+
+func writeMetricFamilies(w io.Writer, families []*dto.MetricFamily) error {
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTextfile writes the metric families to stdout if path is "-",
+// otherwise to the file. The file is replaced atomically so the textfile
+// collector of the node exporter never reads a partial file.
+func writeTextfile(path string, families []*dto.MetricFamily) error {
+	if path == "-" {
+		return writeMetricFamilies(os.Stdout, families)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeMetricFamilies(tmp, families); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
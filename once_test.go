@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRunOnce(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"value": 42}]`))
+	}))
+	defer ts.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer down.Close()
+
+	shared := &WorkerShared{
+		Limiter: NewQueryLimiter(0, nil),
+		Deps:    NewDependencies(),
+	}
+	shared.Services = NewServicePool(StrategyFailover, []ServiceEndpoint{{Name: "up", URL: ts.URL}}, nil)
+	ok := NewWorker(context.Background(), &Query{Name: "once_metric", Interval: DefaultInterval, Timeout: DefaultTimeout}, shared)
+	shared.Services = NewServicePool(StrategyFailover, []ServiceEndpoint{{Name: "down", URL: down.URL}}, nil)
+	failing := NewWorker(context.Background(), &Query{Name: "once_failing_metric", Interval: DefaultInterval, Timeout: DefaultTimeout}, shared)
+
+	dir, err := ioutil.TempDir("", "prometheus-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "sql.prom")
+
+	// Failed queries are not retried until the next interval.
+	start := time.Now()
+	failed, err := runOnce([]*Worker{ok, failing}, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("runOnce took %s", d)
+	}
+	if failed != 1 {
+		t.Errorf("Failed = %d, want 1", failed)
+	}
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"query_result_once_metric 42",
+		`prometheus_sql_query_success{query="once_metric"} 1`,
+		`prometheus_sql_query_success{query="once_failing_metric"} 0`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Output does not contain %q:\n%s", want, b)
+		}
+	}
+
+	// Only the output file is left behind.
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected only the output file, got %d files", len(files))
+	}
+}
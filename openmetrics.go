@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsHandler serves the metrics of the gatherer.
+func metricsHandler(g prometheus.Gatherer) http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, r, g)
+	}))
+}
+
+// serveMetrics writes the metrics of the gatherer. Scrapers asking for the
+// OpenMetrics format also get the exemplars and the _created samples of
+// counters, other scrapers get the text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request, g prometheus.Gatherer) {
+	if expfmt.NegotiateIncludingOpenMetrics(r.Header) != expfmt.FmtOpenMetrics {
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		return
+	}
+
+	families, err := g.Gather()
+	if err != nil {
+		http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeOpenMetrics(&buf, families); err != nil {
+		http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", string(expfmt.FmtOpenMetrics))
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	out.Write(buf.Bytes())
+}
+
+// writeOpenMetrics writes the metric families in the OpenMetrics format.
+// The encoder of the client library doesn't write _created samples, so
+// counter families with created times are written one series at a time,
+// each followed by its _created sample.
+func writeOpenMetrics(w io.Writer, families []*dto.MetricFamily) error {
+	for _, mf := range families {
+		if mf.GetType() != dto.MetricType_COUNTER || !hasCreated(mf) {
+			if _, err := expfmt.MetricFamilyToOpenMetrics(w, mf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The header only.
+		if _, err := expfmt.MetricFamilyToOpenMetrics(w, &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}); err != nil {
+			return err
+		}
+		createdName := strings.TrimSuffix(mf.GetName(), "_total") + "_created"
+		for _, m := range mf.Metric {
+			if err := writeSamples(w, &dto.MetricFamily{Name: mf.Name, Type: mf.Type, Metric: []*dto.Metric{m}}); err != nil {
+				return err
+			}
+			created, ok := counterCreated.get(seriesKey(mf.GetName(), m.Label))
+			if !ok {
+				continue
+			}
+			err := writeSamples(w, &dto.MetricFamily{
+				Name: proto.String(createdName),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{
+					Label: m.Label,
+					Gauge: &dto.Gauge{Value: proto.Float64(float64(created.UnixNano()) / 1e9)},
+				}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+func hasCreated(mf *dto.MetricFamily) bool {
+	for _, m := range mf.Metric {
+		if _, ok := counterCreated.get(seriesKey(mf.GetName(), m.Label)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSamples writes the samples of a metric family without the TYPE line.
+func writeSamples(w io.Writer, mf *dto.MetricFamily) error {
+	var buf bytes.Buffer
+	if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, mf); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	_, err := w.Write(b[bytes.IndexByte(b, '\n')+1:])
+	return err
+}
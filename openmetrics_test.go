@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestOpenMetricsCounter(t *testing.T) {
+	r := NewQueryResult(&Query{
+		Name:           "om_counter",
+		DataField:      "value",
+		Type:           TypeCounter,
+		ExemplarFields: []string{"trace_id"},
+	})
+	if err := r.SetMetrics(records{{"name": "foo", "value": 42, "trace_id": "abc"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	for _, m := range r.Result {
+		reg.MustRegister(m)
+	}
+	h := metricsHandler(reg)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", expfmt.OpenMetricsType+";version="+expfmt.OpenMetricsVersion)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		"# TYPE query_result_om_counter counter\n",
+		`query_result_om_counter_total{name="foo"} 42.0 # {trace_id="abc"} 42.0 `,
+		`query_result_om_counter_created{name="foo"} `,
+		"# EOF\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Output does not contain %q:\n%s", want, body)
+		}
+	}
+
+	// The text format has neither exemplars nor _created samples.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ = ioutil.ReadAll(rec.Body)
+	if !strings.Contains(string(body), `query_result_om_counter_total{name="foo"} 42`) || strings.Contains(string(body), "_created") {
+		t.Errorf("Unexpected text output:\n%s", body)
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	c := newCounterMetric("reset_counter_total", "help", nil)
+	c.Set(10)
+	created, _ := counterCreated.get(c.key)
+
+	time.Sleep(time.Millisecond)
+	c.Set(20)
+	if got, _ := counterCreated.get(c.key); !got.Equal(created) {
+		t.Error("Created time changed for an increasing counter")
+	}
+	c.Set(5)
+	if got, _ := counterCreated.get(c.key); !got.After(created) {
+		t.Error("Created time not updated after a reset")
+	}
+
+	c.forget()
+	if _, ok := counterCreated.get(c.key); ok {
+		t.Error("Created time not removed")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/log/level"
+)
+
+// DefaultQueryDirInclude are the patterns of the files loaded from query
+// directories unless others are given.
+var DefaultQueryDirInclude = []string{"*.yml", "*.yaml"}
+
+// QueryDirOptions define which files are loaded from the query directories.
+type QueryDirOptions struct {
+	// Glob patterns of the files to load. Patterns without a slash match
+	// the file name, others the path relative to the query directory.
+	Include []string
+	// Glob patterns of the files and directories to skip.
+	Exclude []string
+	// Loads *.sql files with a front matter as queries. Files without one
+	// and files referenced with sql-file are skipped.
+	SQLFiles bool
+	// Skips invalid files instead of failing.
+	AllowFileErrors bool
+}
+
+func validateQueryDirOptions(opts QueryDirOptions) error {
+	for _, p := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("Invalid query file pattern [%s]: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// include returns the patterns of the files to load.
+func (o QueryDirOptions) include() []string {
+	if len(o.Include) > 0 {
+		return o.Include
+	}
+	if o.SQLFiles {
+		return append(append([]string{}, DefaultQueryDirInclude...), "*"+SQLFileExt)
+	}
+	return DefaultQueryDirInclude
+}
+
+// matchAny returns whether the slash separated path matches one of the
+// patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		name := rel
+		if !strings.Contains(p, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// queryLoader collects the queries of several files and rejects queries
+// with the same name.
+type queryLoader struct {
+	config  *Config
+	opts    QueryDirOptions
+	queries QueryList
+	// File each query was loaded from.
+	files map[string]string
+	// SQL files found in the query directories, which are loaded once the
+	// files referenced with sql-file are known.
+	sqlFiles []string
+	// Absolute paths of the files referenced with sql-file.
+	referenced map[string]bool
+}
+
+func newQueryLoader(config *Config, opts QueryDirOptions) *queryLoader {
+	return &queryLoader{
+		config:     config,
+		opts:       opts,
+		queries:    make(QueryList, 0),
+		files:      make(map[string]string),
+		referenced: make(map[string]bool),
+	}
+}
+
+// addFile loads the queries of a queries file or, with the .sql extension,
+// of a SQL file. Either all or none of the queries of the file are added.
+func (l *queryLoader) addFile(fn string) error {
+	level.Info(logger).Log("msg", "Loading queries", "file", fn)
+	file, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("Error opening queries file: %s", err)
+	}
+	defer file.Close()
+
+	var queries QueryList
+	if strings.HasSuffix(fn, SQLFileExt) {
+		queries, err = decodeSQLQuery(file, strings.TrimSuffix(filepath.Base(fn), SQLFileExt), l.config)
+	} else {
+		queries, err = decodeQueries(file, filepath.Dir(fn), l.config)
+	}
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(queries))
+	for _, q := range queries {
+		if other, ok := l.files[q.Name]; ok {
+			return fmt.Errorf("Duplicate query [%s] in [%s] and [%s]", q.Name, other, fn)
+		}
+		if seen[q.Name] {
+			return fmt.Errorf("Duplicate query [%s] in [%s]", q.Name, fn)
+		}
+		seen[q.Name] = true
+	}
+	for _, q := range queries {
+		l.files[q.Name] = fn
+		if q.SQLFile != "" {
+			l.reference(q.SQLFile, filepath.Dir(fn))
+		}
+	}
+	l.queries = append(l.queries, queries...)
+	return nil
+}
+
+// reference records a file referenced with sql-file relative to dir.
+func (l *queryLoader) reference(fn, dir string) {
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(dir, fn)
+	}
+	if abs, err := filepath.Abs(fn); err == nil {
+		l.referenced[abs] = true
+	}
+}
+
+// addDir loads the queries of the files in the directory and its
+// subdirectories which match the include and none of the exclude patterns.
+// Hidden files and directories, like the ..data directory of a Kubernetes
+// ConfigMap volume, are skipped. SQL files are only collected, addSQLFiles
+// loads them.
+func (l *queryLoader) addDir(dir string) error {
+	level.Info(logger).Log("msg", "Loading queries from directory", "dir", dir)
+	include := l.opts.include()
+	return filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") || matchAny(l.opts.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !matchAny(include, rel) {
+			return nil
+		}
+		if strings.HasSuffix(fn, SQLFileExt) {
+			if l.opts.SQLFiles {
+				l.sqlFiles = append(l.sqlFiles, fn)
+			}
+			return nil
+		}
+		return l.add(fn)
+	})
+}
+
+// addSQLFiles loads the queries of the SQL files found in the query
+// directories which have a front matter and aren't referenced with sql-file.
+func (l *queryLoader) addSQLFiles() error {
+	for _, fn := range l.sqlFiles {
+		if abs, err := filepath.Abs(fn); err == nil && l.referenced[abs] {
+			level.Debug(logger).Log("msg", "Skipping referenced SQL file", "file", fn)
+			continue
+		}
+		ok, err := hasFrontMatter(fn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			level.Debug(logger).Log("msg", "Skipping SQL file without front matter", "file", fn)
+			continue
+		}
+		if err := l.add(fn); err != nil {
+			return err
+		}
+	}
+	l.sqlFiles = nil
+	return nil
+}
+
+// add loads the queries of a file found in a query directory.
+func (l *queryLoader) add(fn string) error {
+	if err := l.addFile(fn); err != nil {
+		if !l.opts.AllowFileErrors {
+			return err
+		}
+		level.Warn(logger).Log("msg", "Ignoring invalid queries file", "file", fn, "err", err)
+	}
+	return nil
+}
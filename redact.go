@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+)
+
+// DefaultRedactPatterns match the names of the connection properties whose
+// values are masked.
+var DefaultRedactPatterns = []string{"password", "dsn", "token"}
+
+const redacted = "<redacted>"
+
+var (
+	// Matches the separator of a key=value or "key": "value" pair.
+	pairSeparator = regexp.MustCompile(`^[\w.-]+["']?\s*[=:]\s*["']?`)
+	// Matches the password of the user info of an URL.
+	urlPassword = regexp.MustCompile(`(://[^:/@\s]+):[^@\s]+@`)
+)
+
+// Redactor masks secrets in text. It masks the values of pairs with a
+// sensitive key, passwords in URLs and the current values of sensitive
+// connection properties.
+type Redactor struct {
+	mu    sync.RWMutex
+	keys  *regexp.Regexp
+	pairs *regexp.Regexp
+	// Values of the sensitive properties by the query they belong to.
+	values map[string]map[string]struct{}
+}
+
+// redactor is used for all log output.
+var redactor = NewRedactor()
+
+// NewRedactor creates a redactor for the default patterns.
+func NewRedactor() *Redactor {
+	r := &Redactor{values: make(map[string]map[string]struct{})}
+	if err := r.SetPatterns(nil); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// SetPatterns sets the regular expressions matching sensitive keys in
+// addition to the default patterns.
+func (r *Redactor) SetPatterns(patterns []string) error {
+	all := strings.Join(append(append([]string{}, DefaultRedactPatterns...), patterns...), "|")
+	keys, err := regexp.Compile(`(?i)` + all)
+	if err != nil {
+		return err
+	}
+	pairs, err := regexp.Compile(`(?i)[\w.-]*(?:` + all + `)[\w.-]*["']?\s*[=:]\s*["']?[^\s"'&;,]+`)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys, r.pairs = keys, pairs
+	return nil
+}
+
+func validateRedactPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("Invalid redact pattern [%s]: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// sensitive returns whether the values of the key must be masked.
+func (r *Redactor) sensitive(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys.MatchString(key)
+}
+
+// SetValues remembers the values of the sensitive properties of the owner
+// so they are masked wherever they appear. They replace the values the
+// owner had before, so rotated secrets don't pile up.
+func (r *Redactor) SetValues(owner string, props map[string]interface{}) {
+	values := make(map[string]struct{})
+	for k, v := range props {
+		s, ok := v.(string)
+		if !ok || s == "" || !r.sensitive(k) {
+			continue
+		}
+		values[s] = struct{}{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[owner] = values
+}
+
+// String masks the secrets in the text.
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, values := range r.values {
+		for v := range values {
+			s = strings.Replace(s, v, redacted, -1)
+		}
+	}
+	s = r.pairs.ReplaceAllStringFunc(s, func(pair string) string {
+		return pairSeparator.FindString(pair) + redacted
+	})
+	return urlPassword.ReplaceAllString(s, "$1:"+redacted+"@")
+}
+
+// Logger returns a logger masking the secrets in the values before passing
+// them to next. The values are masked before they are encoded, which could
+// escape the secrets.
+func (r *Redactor) Logger(next log.Logger) log.Logger {
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		masked := make([]interface{}, len(keyvals))
+		for i, v := range keyvals {
+			if i%2 == 1 {
+				v = r.value(keyvals[i-1], v)
+			}
+			masked[i] = v
+		}
+		return next.Log(masked...)
+	})
+}
+
+// value masks the secrets in the value of a log message.
+func (r *Redactor) value(key, v interface{}) interface{} {
+	if k, ok := key.(string); ok && r.sensitive(k) {
+		return redacted
+	}
+	switch s := v.(type) {
+	case string:
+		return r.String(s)
+	case error:
+		return r.String(s.Error())
+	case fmt.Stringer:
+		return r.String(s.String())
+	}
+	return v
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor()
+	if err := r.SetPatterns([]string{"secret_.*"}); err != nil {
+		t.Fatal(err)
+	}
+	r.SetValues("q", map[string]interface{}{
+		"host":     "db.example.org",
+		"password": "hunter2",
+		"port":     5432,
+	})
+
+	tests := []struct {
+		in, want string
+	}{
+		{"login failed for hunter2", "login failed for <redacted>"},
+		{"connect: host=db password=s3cret sslmode=disable", "connect: host=db password=<redacted> sslmode=disable"},
+		{`{"dsn": "postgres://u:p@db/x", "user": "u"}`, `{"dsn": "<redacted>", "user": "u"}`},
+		{"dial postgres://admin:pw@db.example.org/x", "dial postgres://admin:<redacted>@db.example.org/x"},
+		{"api_token: abc123", "api_token: <redacted>"},
+		{"secret_key=abc", "secret_key=<redacted>"},
+		{"host db.example.org is down", "host db.example.org is down"},
+	}
+	for _, tt := range tests {
+		if got := r.String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// Values replace the previous values of the owner.
+	r.SetValues("q", map[string]interface{}{"password": "rotated"})
+	r.SetValues("other", map[string]interface{}{"password": "rotated"})
+	if got := r.String("hunter2 rotated"); got != "hunter2 <redacted>" {
+		t.Errorf("String() = %q after rotation", got)
+	}
+	if n := len(r.values["q"]); n != 1 {
+		t.Errorf("Expected 1 value, got %d", n)
+	}
+
+	if err := r.SetPatterns([]string{"("}); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestRedactorLogger(t *testing.T) {
+	r := NewRedactor()
+	secret := `s3"cr\et`
+	r.SetValues("q", map[string]interface{}{"password": secret})
+
+	for _, format := range []string{LogFormatLogfmt, LogFormatJSON} {
+		var buf bytes.Buffer
+		l := log.NewLogfmtLogger(&buf)
+		if format == LogFormatJSON {
+			l = log.NewJSONLogger(&buf)
+		}
+		l = r.Logger(l)
+		l.Log("msg", "Error executing query", "err", fmt.Errorf("login failed for %s", secret), "password", "other", "rows", 1)
+		log.NewStdlibAdapter(l).Write([]byte("500 Internal Server Error: password=hunter2"))
+
+		out := buf.String()
+		for _, s := range []string{"s3", "cr", "other", "hunter2"} {
+			if strings.Contains(out, s) {
+				t.Errorf("[%s] %q not redacted: %s", format, s, out)
+			}
+		}
+		if !strings.Contains(out, "rows") {
+			t.Errorf("[%s] Values missing: %s", format, out)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Default values for the Vault secret provider.
+var (
+	DefaultVaultMount           = "secret"
+	DefaultVaultKVVersion       = 2
+	DefaultVaultRefreshInterval = 5 * time.Minute
+	DefaultVaultTimeout         = 10 * time.Second
+)
+
+// SecretsConfig defines the external providers secret references in data
+// source properties and query connections are resolved with.
+type SecretsConfig struct {
+	Vault *VaultConfig `yaml:"vault"`
+}
+
+// VaultConfig defines a HashiCorp Vault KV secrets engine.
+type VaultConfig struct {
+	Address         string        `yaml:"address"`
+	Token           string        `yaml:"token"`
+	TokenFile       string        `yaml:"token-file"`
+	Mount           string        `yaml:"mount"`
+	KVVersion       int           `yaml:"kv-version"`
+	RefreshInterval time.Duration `yaml:"refresh-interval"`
+	Timeout         time.Duration `yaml:"timeout"`
+}
+
+func validateSecrets(c SecretsConfig) error {
+	if v := c.Vault; v != nil {
+		if v.Address == "" {
+			return errors.New("Address is not defined for the vault secrets")
+		}
+		if v.Token != "" && v.TokenFile != "" {
+			return errors.New("Only one of token and token-file can be set for the vault secrets")
+		}
+		if v.KVVersion != 0 && v.KVVersion != 1 && v.KVVersion != 2 {
+			return fmt.Errorf("Invalid kv-version [%d] for the vault secrets", v.KVVersion)
+		}
+		if v.RefreshInterval < 0 || v.Timeout < 0 {
+			return errors.New("Durations must not be negative for the vault secrets")
+		}
+	}
+	return nil
+}
+
+// SecretProvider returns the secret identified by the arguments of a secret
+// reference, e.g. {{ vault "db/prod" "password" }}.
+type SecretProvider interface {
+	Secret(args ...string) (string, error)
+}
+
+// Secrets resolves the secret references in data source properties and
+// query connections. A property whose value is a mapping with a file key,
+// such as password: {file: /run/secrets/db}, is replaced by the content of
+// the file. String values can refer to secrets with templates calling the
+// providers by name, such as {{ file "/run/secrets/db" }}.
+type Secrets struct {
+	funcs template.FuncMap
+}
+
+// NewSecrets creates the file provider and the configured providers.
+func NewSecrets(c SecretsConfig) *Secrets {
+	s := &Secrets{funcs: template.FuncMap{}}
+	s.Register("file", &fileProvider{files: make(map[string]*secretFile)})
+	if c.Vault != nil {
+		s.Register("vault", NewVaultProvider(*c.Vault))
+	}
+	return s
+}
+
+// Register makes the provider available under the name in templates.
+func (s *Secrets) Register(name string, p SecretProvider) {
+	s.funcs[name] = func(args ...string) (string, error) {
+		return p.Secret(args...)
+	}
+}
+
+// Resolve returns a copy of the properties with the secret references
+// replaced by their current values. Nil secrets return the properties as
+// they are.
+func (s *Secrets) Resolve(props map[string]interface{}) (map[string]interface{}, error) {
+	if s == nil || len(props) == 0 {
+		return props, nil
+	}
+
+	resolved := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		if file, ok := fileReference(v); ok {
+			value, err := s.resolve(fmt.Sprintf("{{ file %q }}", file))
+			if err != nil {
+				return nil, fmt.Errorf("Error resolving property [%s]: %s", k, err)
+			}
+			resolved[k] = value
+			continue
+		}
+
+		str, ok := v.(string)
+		if !ok {
+			resolved[k] = v
+			continue
+		}
+		value, err := s.resolve(str)
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving property [%s]: %s", k, err)
+		}
+		resolved[k] = value
+	}
+	return resolved, nil
+}
+
+// fileReference returns the path of a {file: <path>} property value.
+func fileReference(v interface{}) (string, bool) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	file, ok := m["file"].(string)
+	return file, ok
+}
+
+func (s *Secrets) resolve(value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	t, err := template.New("").Funcs(s.funcs).Parse(value)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// resolveQuerySecrets checks that the secrets of all queries can be
+// resolved. The values are masked in the log output from now on.
+func resolveQuerySecrets(queries QueryList, s *Secrets) error {
+	for _, q := range queries {
+		connection, err := s.Resolve(q.Connection)
+		if err != nil {
+			return fmt.Errorf("%s for query [%s]", err, q.Name)
+		}
+		redactor.SetValues(q.Name, connection)
+	}
+	return nil
+}
+
+// fileProvider reads secrets from files, which are read again whenever
+// they are modified.
+type fileProvider struct {
+	mu    sync.Mutex
+	files map[string]*secretFile
+}
+
+func (p *fileProvider) Secret(args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("file expects the path of the file")
+	}
+	p.mu.Lock()
+	f, ok := p.files[args[0]]
+	if !ok {
+		f = &secretFile{path: args[0]}
+		p.files[args[0]] = f
+	}
+	p.mu.Unlock()
+	return f.get()
+}
+
+// VaultProvider reads secrets from a HashiCorp Vault KV secrets engine.
+// The secrets are cached and read again after the refresh interval.
+type VaultProvider struct {
+	config    VaultConfig
+	client    *http.Client
+	tokenFile *secretFile
+
+	mu    sync.Mutex
+	cache map[string]vaultSecret
+}
+
+type vaultSecret struct {
+	data    map[string]interface{}
+	fetched time.Time
+}
+
+// NewVaultProvider creates a provider for the Vault server. Without a
+// token the VAULT_TOKEN environment variable is used.
+func NewVaultProvider(c VaultConfig) *VaultProvider {
+	if c.Mount == "" {
+		c.Mount = DefaultVaultMount
+	}
+	if c.KVVersion == 0 {
+		c.KVVersion = DefaultVaultKVVersion
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultVaultRefreshInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultVaultTimeout
+	}
+	if c.Token == "" && c.TokenFile == "" {
+		c.Token = os.Getenv("VAULT_TOKEN")
+	}
+	p := &VaultProvider{
+		config: c,
+		client: &http.Client{Timeout: c.Timeout},
+		cache:  make(map[string]vaultSecret),
+	}
+	if c.TokenFile != "" {
+		p.tokenFile = &secretFile{path: c.TokenFile}
+	}
+	return p
+}
+
+// Secret returns the value of a key of the secret at a path.
+func (p *VaultProvider) Secret(args ...string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("vault expects the path and the key of the secret")
+	}
+	path, key := args[0], args[1]
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.cache[path]
+	if !ok || time.Since(s.fetched) > p.config.RefreshInterval {
+		data, err := p.read(path)
+		switch {
+		case err == nil:
+			s = vaultSecret{data: data, fetched: time.Now()}
+			p.cache[path] = s
+		case ok:
+			// Keep using the previous value while Vault is not available.
+			level.Warn(logger).Log("msg", "Error refreshing vault secret", "path", path, "err", err)
+		default:
+			return "", fmt.Errorf("Error reading vault secret [%s]: %s", path, err)
+		}
+	}
+
+	v, ok := s.data[key]
+	if !ok {
+		return "", fmt.Errorf("Key [%s] not found in vault secret [%s]", key, path)
+	}
+	return fmt.Sprintf("%v", v), nil
+}
+
+func (p *VaultProvider) read(path string) (map[string]interface{}, error) {
+	url := fmt.Sprintf("%s/v1/%s", strings.TrimRight(p.config.Address, "/"), p.config.Mount)
+	if p.config.KVVersion == 2 {
+		url += "/data"
+	}
+	url += "/" + strings.TrimLeft(path, "/")
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := p.config.Token
+	if p.tokenFile != nil {
+		if token, err = p.tokenFile.get(); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, string(b))
+	}
+
+	// Version 2 of the KV engine wraps the data with its metadata.
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if p.config.KVVersion == 2 {
+		data, _ := body.Data["data"].(map[string]interface{})
+		return data, nil
+	}
+	return body.Data, nil
+}
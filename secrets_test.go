@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretsResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(file, []byte("s3cr$t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSecrets(SecretsConfig{})
+	props := map[string]interface{}{
+		"host":          "localhost",
+		"port":          5432,
+		"password":      map[interface{}]interface{}{"file": file},
+		"dsn":           `user:{{ file "` + file + `" }}@db`,
+		"ssl_cert_file": "/etc/ssl/client.pem",
+	}
+	got, err := s.Resolve(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"host":          "localhost",
+		"port":          5432,
+		"password":      "s3cr$t",
+		"dsn":           "user:s3cr$t@db",
+		"ssl_cert_file": "/etc/ssl/client.pem",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := props["password"].(string); ok {
+		t.Error("Properties were modified")
+	}
+
+	if _, err := s.Resolve(map[string]interface{}{"password": map[interface{}]interface{}{"file": filepath.Join(dir, "missing")}}); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	requests := 0
+	available := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/db/prod" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"password": "from-vault"}, "metadata": {"version": 1}}}`))
+	}))
+	defer ts.Close()
+
+	s := NewSecrets(SecretsConfig{})
+	p := NewVaultProvider(VaultConfig{Address: ts.URL, Token: "root", RefreshInterval: time.Millisecond})
+	s.Register("vault", p)
+
+	resolve := func() (interface{}, error) {
+		got, err := s.Resolve(map[string]interface{}{"password": `{{ vault "db/prod" "password" }}`})
+		if err != nil {
+			return nil, err
+		}
+		return got["password"], nil
+	}
+
+	if got, err := resolve(); err != nil || got != "from-vault" {
+		t.Fatalf("password = %v (%v), want from-vault", got, err)
+	}
+
+	// The cached value is used while vault is not available.
+	available = false
+	time.Sleep(2 * time.Millisecond)
+	if got, err := resolve(); err != nil || got != "from-vault" {
+		t.Errorf("password = %v (%v), want from-vault", got, err)
+	}
+	if requests != 2 {
+		t.Errorf("Requests = %d, want 2", requests)
+	}
+
+	if _, err := s.Resolve(map[string]interface{}{"password": `{{ vault "db/other" "password" }}`}); err == nil {
+		t.Error("Expected error for unknown secret")
+	}
+}
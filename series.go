@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "prometheus_sql_query_errors_total",
+	Help: "Number of errors while setting the metrics of a query",
+}, []string{"query", "reason"})
+
+func init() {
+	prometheus.MustRegister(queryErrors)
+}
+
+// countQueryError counts an error of the query.
+func countQueryError(query, reason string) {
+	queryErrors.WithLabelValues(query, reason).Inc()
+}
+
+// SeriesBudget limits the total number of series exposed for all queries.
+// It is shared by all query results.
+type SeriesBudget struct {
+	max int
+
+	mu    sync.Mutex
+	total int
+}
+
+// NewSeriesBudget creates a budget of max series, zero means unlimited.
+func NewSeriesBudget(max int) *SeriesBudget {
+	return &SeriesBudget{max: max}
+}
+
+// reserve replaces the current series of a query with the new number of
+// series, failing if that exceeds the budget. A nil budget is unlimited.
+func (b *SeriesBudget) reserve(current, new int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := b.total - current + new
+	if b.max > 0 && new > current && total > b.max {
+		return fmt.Errorf("Exposing %d series would exceed the global limit of %d series", new, b.max)
+	}
+	b.total = total
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+)
+
+var (
+	serviceOpenConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_sql_service_open_connections",
+		Help: "Number of open connections to the SQL agent services",
+	})
+
+	serviceRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_sql_service_requests_in_flight",
+		Help: "Number of requests to the SQL agent services waiting for a response",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(serviceOpenConnections, serviceRequestsInFlight)
+}
+
+// ServiceConfig defines how the SQL agent service is accessed.
+type ServiceConfig struct {
+	URL             string            `yaml:"url"`
+	Strategy        string            `yaml:"strategy"`
+	Format          string            `yaml:"format"`
+	TLS             TLSConfig         `yaml:"tls"`
+	BasicAuth       *BasicAuth        `yaml:"basic-auth"`
+	BearerToken     string            `yaml:"bearer-token"`
+	BearerTokenFile string            `yaml:"bearer-token-file"`
+	Headers         map[string]string `yaml:"headers"`
+	ProxyURL        string            `yaml:"proxy-url"`
+	Transport       TransportConfig   `yaml:"transport"`
+}
+
+// TransportConfig tunes the connections to the SQL agent. Zero values use
+// the defaults of the Go HTTP client.
+type TransportConfig struct {
+	MaxIdleConns        int           `yaml:"max-idle-conns"`
+	MaxIdleConnsPerHost int           `yaml:"max-idle-conns-per-host"`
+	MaxConnsPerHost     int           `yaml:"max-conns-per-host"`
+	IdleConnTimeout     time.Duration `yaml:"idle-conn-timeout"`
+	DisableHTTP2        bool          `yaml:"disable-http2"`
+	CompressRequests    bool          `yaml:"compress-requests"`
+}
+
+// TLSConfig defines the TLS settings used to connect to the SQL agent.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca-file"`
+	CertFile           string `yaml:"cert-file"`
+	KeyFile            string `yaml:"key-file"`
+	ServerName         string `yaml:"server-name"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+}
+
+// BasicAuth defines the credentials for HTTP basic authentication.
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password-file"`
+}
+
+func validateServiceConfig(c ServiceConfig) error {
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("Both cert-file and key-file must be set for the service")
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return errors.New("Only one of bearer-token and bearer-token-file can be set for the service")
+	}
+	if c.BasicAuth != nil && (c.BearerToken != "" || c.BearerTokenFile != "") {
+		return errors.New("Only one of basic-auth and bearer token can be set for the service")
+	}
+	if c.BasicAuth != nil && c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+		return errors.New("Only one of password and password-file can be set for the service basic-auth")
+	}
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("Invalid proxy-url for the service: %s", err)
+		}
+	}
+	if _, ok := formatMediaTypes[c.Format]; c.Format != "" && !ok {
+		return fmt.Errorf("Invalid format [%s] for the service", c.Format)
+	}
+	t := c.Transport
+	if t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 || t.MaxConnsPerHost < 0 || t.IdleConnTimeout < 0 {
+		return errors.New("Transport values must not be negative for the service")
+	}
+	return nil
+}
+
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		b, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in CA file [%s]", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// NewServiceTransport creates the transport shared by all workers to send
+// requests to the SQL agent.
+func NewServiceTransport(c ServiceConfig) (http.RoundTripper, error) {
+	tc, err := newTLSConfig(c.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tc
+	if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = countingDialer(dialer.DialContext)
+
+	if c.Transport.MaxIdleConns != 0 {
+		t.MaxIdleConns = c.Transport.MaxIdleConns
+	}
+	if c.Transport.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = c.Transport.MaxIdleConnsPerHost
+	}
+	if c.Transport.MaxConnsPerHost != 0 {
+		t.MaxConnsPerHost = c.Transport.MaxConnsPerHost
+	}
+	if c.Transport.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = c.Transport.IdleConnTimeout
+	}
+	if c.Transport.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	rt := &serviceRoundTripper{
+		next:     promhttp.InstrumentRoundTripperInFlight(serviceRequestsInFlight, t),
+		headers:  c.Headers,
+		auth:     c.BasicAuth,
+		token:    c.BearerToken,
+		compress: c.Transport.CompressRequests,
+	}
+	if c.BearerTokenFile != "" {
+		rt.tokenFile = &secretFile{path: c.BearerTokenFile}
+	}
+	if c.BasicAuth != nil && c.BasicAuth.PasswordFile != "" {
+		rt.passwordFile = &secretFile{path: c.BasicAuth.PasswordFile}
+	}
+	return rt, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// countingDialer tracks the number of open connections.
+func countingDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		serviceOpenConnections.Inc()
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(serviceOpenConnections.Dec)
+	return c.Conn.Close()
+}
+
+// secretFile holds the content of a file which is read again whenever the
+// file has been modified.
+type secretFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	value   string
+}
+
+func (f *secretFile) get() (string, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !fi.ModTime().Equal(f.modTime) {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return "", err
+		}
+		f.value = strings.TrimSpace(string(b))
+		f.modTime = fi.ModTime()
+	}
+	return f.value, nil
+}
+
+// serviceRoundTripper adds the authentication and custom headers to the
+// requests sent to the SQL agent.
+type serviceRoundTripper struct {
+	next         http.RoundTripper
+	headers      map[string]string
+	auth         *BasicAuth
+	passwordFile *secretFile
+	token        string
+	tokenFile    *secretFile
+	compress     bool
+}
+
+func (rt *serviceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A round tripper must not modify the original request.
+	req = req.Clone(req.Context())
+
+	for k, v := range rt.headers {
+		req.Header.Set(k, v)
+	}
+
+	if rt.auth != nil {
+		password := rt.auth.Password
+		if rt.passwordFile != nil {
+			p, err := rt.passwordFile.get()
+			if err != nil {
+				return nil, fmt.Errorf("Error reading password file: %s", err)
+			}
+			password = p
+		}
+		req.SetBasicAuth(rt.auth.Username, password)
+	}
+
+	token := rt.token
+	if rt.tokenFile != nil {
+		t, err := rt.tokenFile.get()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading bearer token file: %s", err)
+		}
+		token = t
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if rt.compress && req.Body != nil {
+		if err := compressBody(req); err != nil {
+			return nil, err
+		}
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// compressBody replaces the body of the request with its gzip encoding.
+func compressBody(req *http.Request) error {
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	body := buf.Bytes()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
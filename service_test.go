@@ -0,0 +1,139 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceTransportAuth(t *testing.T) {
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "prometheus-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := NewServiceTransport(ServiceConfig{
+		BearerTokenFile: tokenFile,
+		Headers:         map[string]string{"X-Team": "dbhi"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+
+	if _, err := client.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if h := got.Header.Get("Authorization"); h != "Bearer first" {
+		t.Errorf("Authorization = %q, want %q", h, "Bearer first")
+	}
+	if h := got.Header.Get("X-Team"); h != "dbhi" {
+		t.Errorf("X-Team = %q, want %q", h, "dbhi")
+	}
+
+	// The token is read again once the file changed.
+	if err := ioutil.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if h := got.Header.Get("Authorization"); h != "Bearer second" {
+		t.Errorf("Authorization = %q, want %q", h, "Bearer second")
+	}
+}
+
+func TestServiceTransportBasicAuth(t *testing.T) {
+	var user, pass string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ = r.BasicAuth()
+	}))
+	defer ts.Close()
+
+	rt, err := NewServiceTransport(ServiceConfig{
+		BasicAuth: &BasicAuth{Username: "agent", Password: "s3cr3t"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: rt}).Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if user != "agent" || pass != "s3cr3t" {
+		t.Errorf("Basic auth = %s:%s, want agent:s3cr3t", user, pass)
+	}
+}
+
+func TestServiceTransportTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	rt, err := NewServiceTransport(ServiceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: rt}).Get(ts.URL); err == nil {
+		t.Error("Expected error for untrusted certificate")
+	}
+
+	rt, err = NewServiceTransport(ServiceConfig{TLS: TLSConfig{InsecureSkipVerify: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: rt}).Get(ts.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceTransportCompression(t *testing.T) {
+	var body, encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	rt, err := NewServiceTransport(ServiceConfig{Transport: TransportConfig{CompressRequests: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: rt}).Post(ts.URL, "application/json", strings.NewReader(`{"sql":"select 1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if body != `{"sql":"select 1"}` {
+		t.Errorf("Body = %q", body)
+	}
+}
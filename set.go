@@ -4,11 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type record map[string]interface{}
@@ -16,6 +21,8 @@ type records []record
 
 type metricStatus int
 
+const statusHelp = "Threshold status of an SQL query result (0 = ok, 1 = warning, 2 = critical)"
+
 const (
 	registered metricStatus = iota
 	unregistered
@@ -24,23 +31,43 @@ const (
 // QueryResult contains query results
 type QueryResult struct {
 	Query  *Query
-	Result map[string]prometheus.Gauge // Internally we represent each facet with a JSON-encoded string for simplicity
+	Result map[string]resultMetric // Internally we represent each facet with a JSON-encoded string for simplicity
+	Budget *SeriesBudget           // Limits the series of all queries, nil means unlimited
+
+	// Registry of the metrics of all query results, apart from the metrics
+	// of the exporter itself. Nil means the metrics are not registered.
+	Registry *prometheus.Registry
+
+	// Guards changes of Result while the metrics are gathered by another
+	// goroutine.
+	mu sync.RWMutex
+}
+
+// pendingMetric is a value read from the result set which is only set once
+// the whole result set has been read successfully.
+type pendingMetric struct {
+	facets   map[string]interface{}
+	suffix   string
+	help     string
+	value    float64
+	counter  bool
+	exemplar prometheus.Labels
 }
 
 // NewQueryResult initializes a new metrics collector.
 func NewQueryResult(q *Query) *QueryResult {
 	r := &QueryResult{
 		Query:  q,
-		Result: make(map[string]prometheus.Gauge),
+		Result: make(map[string]resultMetric),
 	}
 
 	return r
 }
 
 func (r *QueryResult) generateMetricName(suffix string) string {
-	metricName := r.Query.Name
+	metricName := r.Query.metricName()
 	if suffix != "" {
-		metricName = fmt.Sprintf("%s_%s", r.Query.Name, suffix)
+		metricName = fmt.Sprintf("%s_%s", metricName, suffix)
 	}
 	return metricName
 }
@@ -50,7 +77,7 @@ func (r *QueryResult) generateMetricUniqueKey(facets map[string]interface{}, suf
 	return fmt.Sprintf("%s%s", r.generateMetricName(suffix), string(jsonData))
 }
 
-func (r *QueryResult) createMetric(facets map[string]interface{}, suffix string, help string) (string, metricStatus) {
+func (r *QueryResult) createMetric(facets map[string]interface{}, suffix string, help string, counter bool) (string, metricStatus) {
 	metricName := r.generateMetricName(suffix)
 	resultKey := r.generateMetricUniqueKey(facets, suffix)
 
@@ -68,53 +95,123 @@ func (r *QueryResult) createMetric(facets map[string]interface{}, suffix string,
 		help = "Result of an SQL query"
 	}
 
-	fmt.Println("Creating", resultKey)
+	level.Debug(logger).Log("msg", "Creating metric", "query", r.Query.Name, "metric", resultKey)
+	name := fmt.Sprintf("query_result_%s", metricName)
+	if counter {
+		r.Result[resultKey] = newCounterMetric(counterName(name), help, labels)
+		return resultKey, unregistered
+	}
 	r.Result[resultKey] = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name:        fmt.Sprintf("query_result_%s", metricName),
+		Name:        name,
 		Help:        help,
 		ConstLabels: labels,
 	})
 	return resultKey, unregistered
 }
 
-func setValueForResult(r prometheus.Gauge, v interface{}) error {
+func valueForResult(v interface{}) (float64, error) {
 	switch t := v.(type) {
 	case nil:
-		r.Set(math.NaN())
+		return math.NaN(), nil
 	case string:
-		f, err := strconv.ParseFloat(t, 64)
-		if err != nil {
-			return err
-		}
-		r.Set(f)
+		return strconv.ParseFloat(t, 64)
 	case int:
-		r.Set(float64(t))
+		return float64(t), nil
 	case float64:
-		r.Set(t)
+		return t, nil
 	default:
-		return fmt.Errorf("Unhandled type %s", t)
+		return 0, fmt.Errorf("Unhandled type %s", t)
 	}
+}
+
+func setValueForResult(r resultMetric, v interface{}) error {
+	f, err := valueForResult(v)
+	if err != nil {
+		return err
+	}
+	r.Set(f)
 	return nil
 }
 
+// statusMetricSuffix returns the suffix of the status metric for the
+// metric with the given suffix.
+func statusMetricSuffix(suffix string) string {
+	if suffix == "" {
+		return statusSuffix
+	}
+	return fmt.Sprintf("%s_%s", suffix, statusSuffix)
+}
+
 // SetMetrics set and register metrics
 func (r *QueryResult) SetMetrics(recs records, valueOnError string) error {
-	// Queries that return only one record should only have one column
-	if len(recs) > 1 && len(recs[0]) == 1 {
-		return errors.New("There is more than one row in the query result - with a single column")
-	}
+	return r.SetMetricsFrom(recs.iterator(), valueOnError)
+}
 
+// SetMetricsFrom sets and registers the metrics from records which are read
+// one at a time, so large result sets don't have to be kept in memory.
+func (r *QueryResult) SetMetricsFrom(next recordIterator, valueOnError string) error {
 	if r.Query.DataField != "" && len(r.Query.SubMetrics) > 0 {
 		return errors.New("sub-metrics are not compatible with data-field")
 	}
 
+	submetrics := map[string]string{}
+
+	if len(r.Query.SubMetrics) > 0 {
+		submetrics = r.Query.SubMetrics
+	} else {
+		submetrics = map[string]string{"": r.Query.DataField}
+	}
+
+	// The current metrics are kept until the whole result set has been read
+	// so a failure never replaces them partially.
+	pending := make(map[string]pendingMetric)
+	var rows, firstColumns int
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		row, exemplar, err := r.splitExemplar(row)
+		if err != nil {
+			return err
+		}
+
+		rows++
+		if rows == 1 {
+			firstColumns = len(row)
+		}
+		// Queries that return only one record should only have one column
+		if rows == 2 && firstColumns == 1 {
+			return errors.New("There is more than one row in the query result - with a single column")
+		}
+
+		if err := r.setRow(row, exemplar, submetrics, pending); err != nil {
+			return err
+		}
+		if r.Query.MaxSeries > 0 && len(pending) > r.Query.MaxSeries {
+			countQueryError(r.Query.Name, "series_limit")
+			return fmt.Errorf("Query result exceeds the limit of %d series", r.Query.MaxSeries)
+		}
+	}
+
 	// We need to make sure not to default to a value on error before
 	// it has been registered once before since re-registering might
 	// not work if different labels are used.
-	if len(recs) == 0 && valueOnError != "" {
+	if rows == 0 && valueOnError != "" {
+		// The threshold status is not a query result.
+		status := make(map[string]bool)
+		if r.Query.Thresholds.Defined() {
+			for suffix := range submetrics {
+				status[r.generateMetricName(statusMetricSuffix(suffix))] = true
+			}
+		}
 		metricSet := false
 		for k := range r.Result {
-			if strings.HasPrefix(k, r.generateMetricName("")) {
+			if strings.HasPrefix(k, r.generateMetricName("")) && !status[k[:strings.Index(k, "{")]] {
 				err := setValueForResult(r.Result[k], valueOnError)
 				if err != nil {
 					return err
@@ -127,73 +224,151 @@ func (r *QueryResult) SetMetrics(recs records, valueOnError string) error {
 		}
 	}
 
-	submetrics := map[string]string{}
+	if err := r.Budget.reserve(len(r.Result), len(pending)); err != nil {
+		countQueryError(r.Query.Name, "series_limit")
+		return err
+	}
 
-	if len(r.Query.SubMetrics) > 0 {
-		submetrics = r.Query.SubMetrics
-	} else {
-		submetrics = map[string]string{"": r.Query.DataField}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	facetsWithResult := make(map[string]metricStatus, len(pending))
+	for _, m := range pending {
+		key, status := r.createMetric(m.facets, m.suffix, m.help, m.counter)
+		r.Result[key].Set(m.value)
+		if c, ok := r.Result[key].(*counterMetric); ok {
+			c.setExemplar(m.exemplar)
+		}
+		facetsWithResult[key] = status
 	}
+	r.registerMetrics(facetsWithResult)
+	return nil
+}
 
-	facetsWithResult := make(map[string]metricStatus, 0)
-	for _, row := range recs {
-		for suffix, datafield := range submetrics {
-			facet := make(map[string]interface{})
-			var (
-				dataVal   interface{}
-				dataFound bool
-			)
-			for k, v := range row {
-				if len(row) > 1 && strings.ToLower(k) != datafield { // facet field, add to facets
-					submetric := false
-					for _, n := range submetrics {
-						if strings.ToLower(k) == n {
-							submetric = true
-						}
-					}
-					// it is a facet field and not a submetric field
-					if !submetric {
-						facet[strings.ToLower(fmt.Sprintf("%v", k))] = v
-					}
-				} else { // this is the actual gauge data
-					if dataFound {
-						return errors.New("Data field not specified for multi-column query")
+// splitExemplar removes the exemplar fields from a record and returns their
+// values as exemplar labels.
+func (r *QueryResult) splitExemplar(row record) (record, prometheus.Labels, error) {
+	if len(r.Query.ExemplarFields) == 0 {
+		return row, nil, nil
+	}
+	values := make(record, len(row))
+	exemplar := prometheus.Labels{}
+	runes := 0
+	for k, v := range row {
+		field := strings.ToLower(k)
+		if !r.Query.isExemplarField(field) {
+			values[k] = v
+			continue
+		}
+		if v != nil {
+			exemplar[field] = fmt.Sprintf("%v", v)
+			runes += utf8.RuneCountInString(field) + utf8.RuneCountInString(exemplar[field])
+		}
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		return nil, nil, fmt.Errorf("Exemplar labels have %d runes, exceeding the limit of %d", runes, prometheus.ExemplarMaxRunes)
+	}
+	return values, exemplar, nil
+}
+
+// setRow reads the metrics of a single record.
+func (r *QueryResult) setRow(row record, exemplar prometheus.Labels, submetrics map[string]string, pending map[string]pendingMetric) error {
+	for suffix, datafield := range submetrics {
+		facet := make(map[string]interface{})
+		var (
+			dataVal   interface{}
+			dataFound bool
+		)
+		for k, v := range row {
+			if len(row) > 1 && strings.ToLower(k) != datafield { // facet field, add to facets
+				submetric := false
+				for _, n := range submetrics {
+					if strings.ToLower(k) == n {
+						submetric = true
 					}
-					dataVal = v
-					dataFound = true
 				}
+				// it is a facet field and not a submetric field
+				if !submetric {
+					facet[strings.ToLower(fmt.Sprintf("%v", k))] = v
+				}
+			} else { // this is the actual gauge data
+				if dataFound {
+					return errors.New("Data field not specified for multi-column query")
+				}
+				dataVal = v
+				dataFound = true
 			}
+		}
 
-			if !dataFound {
-				return errors.New("Data field not found in result set")
-			}
+		if !dataFound {
+			return errors.New("Data field not found in result set")
+		}
+		// The labels of the query tell the variants of a query apart and
+		// take precedence over the columns.
+		for k, v := range r.Query.Labels {
+			facet[k] = v
+		}
 
-			key, status := r.createMetric(facet, suffix, r.Query.Help)
-			err := setValueForResult(r.Result[key], dataVal)
-			if err != nil {
-				return err
+		value, err := valueForResult(dataVal)
+		if err != nil {
+			return err
+		}
+		pending[r.generateMetricUniqueKey(facet, suffix)] = pendingMetric{
+			facets:   facet,
+			suffix:   suffix,
+			help:     r.Query.Help,
+			value:    value,
+			counter:  r.Query.Type == TypeCounter,
+			exemplar: exemplar,
+		}
+
+		// Expose whether the value is within the thresholds.
+		if r.Query.Thresholds.Defined() {
+			thresholdSuffix := statusMetricSuffix(suffix)
+			pending[r.generateMetricUniqueKey(facet, thresholdSuffix)] = pendingMetric{
+				facets: facet,
+				suffix: thresholdSuffix,
+				help:   statusHelp,
+				value:  r.Query.Thresholds.Status(value),
 			}
-			facetsWithResult[key] = status
 		}
 	}
-	r.registerMetrics(facetsWithResult)
 	return nil
 }
 
+// Gather returns the current metrics of the query.
+func (r *QueryResult) Gather() ([]*dto.MetricFamily, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reg := prometheus.NewRegistry()
+	for _, m := range r.Result {
+		if err := reg.Register(m); err != nil {
+			return nil, err
+		}
+	}
+	return reg.Gather()
+}
+
 // RegisterMetrics registers and unregister gauges
 func (r *QueryResult) registerMetrics(facetsWithResult map[string]metricStatus) {
 	for key, m := range r.Result {
 		status, ok := facetsWithResult[key]
 		if !ok {
-			fmt.Println("Unregistering metric", key)
-			prometheus.Unregister(m)
+			level.Debug(logger).Log("msg", "Unregistering metric", "query", r.Query.Name, "metric", key)
+			if r.Registry != nil {
+				r.Registry.Unregister(m)
+			}
+			if c, ok := m.(*counterMetric); ok {
+				c.forget()
+			}
 			delete(r.Result, key)
 			continue
 		}
-		if status == unregistered {
-			defer func(key string, m prometheus.Gauge) {
-				fmt.Println("Registering metric", key)
-				prometheus.MustRegister(m)
+		if status == unregistered && r.Registry != nil {
+			defer func(key string, m resultMetric) {
+				level.Debug(logger).Log("msg", "Registering metric", "query", r.Query.Name, "metric", key)
+				r.Registry.MustRegister(m)
 			}(key, m)
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -163,3 +164,165 @@ func TestNilValue(t *testing.T) {
 		},
 	}).testQuerySet(t)
 }
+
+func TestThresholds(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:      "threshold_metric",
+			DataField: "value",
+			Thresholds: Thresholds{
+				Warning:  &Threshold{Operator: ">", Value: 10},
+				Critical: &Threshold{Operator: ">=", Value: 100},
+			},
+		}),
+		rec: records{
+			record{"name": "ok", "value": 5},
+			record{"name": "warn", "value": 50},
+			record{"name": "crit", "value": 100},
+		},
+		results: map[string]string{
+			`threshold_metric{"name":"ok"}`:          "label: <\n  name: \"name\"\n  value: \"ok\"\n>\ngauge: <\n  value: 5\n>\n",
+			`threshold_metric{"name":"warn"}`:        "label: <\n  name: \"name\"\n  value: \"warn\"\n>\ngauge: <\n  value: 50\n>\n",
+			`threshold_metric{"name":"crit"}`:        "label: <\n  name: \"name\"\n  value: \"crit\"\n>\ngauge: <\n  value: 100\n>\n",
+			`threshold_metric_status{"name":"ok"}`:   "label: <\n  name: \"name\"\n  value: \"ok\"\n>\ngauge: <\n  value: 0\n>\n",
+			`threshold_metric_status{"name":"warn"}`: "label: <\n  name: \"name\"\n  value: \"warn\"\n>\ngauge: <\n  value: 1\n>\n",
+			`threshold_metric_status{"name":"crit"}`: "label: <\n  name: \"name\"\n  value: \"crit\"\n>\ngauge: <\n  value: 2\n>\n",
+		},
+	}).testQuerySet(t)
+}
+
+func TestThresholdsValueOnError(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:       "threshold_error_metric",
+		Thresholds: Thresholds{Warning: &Threshold{Operator: ">", Value: 10}},
+	})
+	if err := q.SetMetrics(records{{"value": 50}}, "-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetMetrics(records{}, "-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"threshold_error_metric{}":        -1,
+		"threshold_error_metric_status{}": 1,
+	}
+	for k, v := range want {
+		metric := &dto.Metric{}
+		q.Result[k].Write(metric)
+		if got := metric.GetGauge().GetValue(); got != v {
+			t.Errorf("%s = %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:      "max_series_metric",
+		DataField: "value",
+		MaxSeries: 2,
+	})
+	if err := q.SetMetrics(records{{"name": "foo", "value": 1}, {"name": "bar", "value": 2}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous series are kept if the limit is exceeded.
+	err := q.SetMetrics(records{{"name": "foo", "value": 3}, {"name": "bar", "value": 4}, {"name": "baz", "value": 5}}, "")
+	if err == nil {
+		t.Fatal("Expected error when exceeding max series")
+	}
+	if len(q.Result) != 2 {
+		t.Fatalf("Expected 2 series, got %d", len(q.Result))
+	}
+	metric := &dto.Metric{}
+	q.Result[`max_series_metric{"name":"foo"}`].Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 1 {
+		t.Errorf("Expected previous value 1, got %v", v)
+	}
+}
+
+func TestSeriesBudget(t *testing.T) {
+	budget := NewSeriesBudget(3)
+	a := NewQueryResult(&Query{Name: "budget_metric_a", DataField: "value"})
+	a.Budget = budget
+	b := NewQueryResult(&Query{Name: "budget_metric_b", DataField: "value"})
+	b.Budget = budget
+
+	if err := a.SetMetrics(records{{"name": "foo", "value": 1}, {"name": "bar", "value": 2}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetMetrics(records{{"name": "foo", "value": 1}, {"name": "bar", "value": 2}}, ""); err == nil {
+		t.Fatal("Expected error when exceeding the global limit")
+	}
+	if err := b.SetMetrics(records{{"name": "foo", "value": 1}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Series removed from one query can be used by another.
+	if err := a.SetMetrics(records{{"name": "foo", "value": 1}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetMetrics(records{{"name": "foo", "value": 1}, {"name": "bar", "value": 2}}, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryRegistry(t *testing.T) {
+	queryRegistry := prometheus.NewRegistry()
+	r := NewQueryResult(&Query{Name: "registry_metric"})
+	r.Registry = queryRegistry
+	if err := r.SetMetrics(records{{"value": 1}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	hasFamily := func(g prometheus.Gatherer) bool {
+		families, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == "query_result_registry_metric" {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasFamily(queryRegistry) {
+		t.Error("Query result not in the query registry")
+	}
+	if hasFamily(prometheus.DefaultGatherer) {
+		t.Error("Query result in the default registry")
+	}
+}
+
+func TestQueryVariants(t *testing.T) {
+	acme := NewQueryResult(&Query{Name: `variant_metric{tenant="acme"}`, metric: "variant_metric", Labels: map[string]string{"tenant": "acme"}})
+	globex := NewQueryResult(&Query{Name: `variant_metric{tenant="globex"}`, metric: "variant_metric", Labels: map[string]string{"tenant": "globex"}})
+	queryRegistry := prometheus.NewRegistry()
+	acme.Registry, globex.Registry = queryRegistry, queryRegistry
+	if err := acme.SetMetrics(records{{"value": 1}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := globex.SetMetrics(records{{"value": 2}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for r, want := range map[*QueryResult]string{
+		acme:   `variant_metric{"tenant":"acme"}`,
+		globex: `variant_metric{"tenant":"globex"}`,
+	} {
+		if _, ok := r.Result[want]; !ok || len(r.Result) != 1 {
+			t.Errorf("Expected only %s in %v", want, r.Result)
+		}
+	}
+
+	families, err := queryRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "query_result_variant_metric" && len(mf.Metric) != 2 {
+			t.Errorf("Expected 2 series, got %d", len(mf.Metric))
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Default values for the remote write output.
+var (
+	DefaultRemoteWriteBatchSize     = 500
+	DefaultRemoteWriteFlushInterval = 10 * time.Second
+	DefaultRemoteWriteMaxRetries    = 3
+	DefaultOutputTimeout            = 30 * time.Second
+)
+
+// OutputsConfig defines where query results are sent in addition to the
+// metrics endpoint.
+type OutputsConfig struct {
+	Pushgateway *PushgatewayConfig `yaml:"pushgateway"`
+	RemoteWrite *RemoteWriteConfig `yaml:"remote-write"`
+}
+
+// PushgatewayConfig defines the Pushgateway the results of each query are
+// pushed to, grouped by query and data source.
+type PushgatewayConfig struct {
+	URL     string        `yaml:"url"`
+	Job     string        `yaml:"job"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RemoteWriteConfig defines the Prometheus remote write endpoint samples
+// are sent to in batches.
+type RemoteWriteConfig struct {
+	URL           string            `yaml:"url"`
+	Labels        map[string]string `yaml:"labels"`
+	BatchSize     int               `yaml:"batch-size"`
+	FlushInterval time.Duration     `yaml:"flush-interval"`
+	MaxRetries    int               `yaml:"max-retries"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+var (
+	remoteWriteSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_sql_remote_write_samples_total",
+		Help: "Number of samples handled by the remote write output by result (sent, failed, dropped)",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteSamples)
+}
+
+func validateOutputs(c OutputsConfig) error {
+	if p := c.Pushgateway; p != nil {
+		if p.URL == "" {
+			return errors.New("URL is not defined for the pushgateway output")
+		}
+		if p.Timeout < 0 {
+			return errors.New("Timeout must not be negative for the pushgateway output")
+		}
+	}
+	if r := c.RemoteWrite; r != nil {
+		if r.URL == "" {
+			return errors.New("URL is not defined for the remote write output")
+		}
+		if r.BatchSize < 0 || r.FlushInterval < 0 || r.MaxRetries < 0 || r.Timeout < 0 {
+			return errors.New("Values must not be negative for the remote write output")
+		}
+	}
+	return nil
+}
+
+// Sink receives the metrics of a query after each successful execution.
+type Sink interface {
+	Push(q *Query, families []*dto.MetricFamily) error
+}
+
+// NewSinks creates the configured sinks. Sinks with background work are
+// stopped when the context is done and marked done in the wait group once
+// they have finished.
+func NewSinks(ctx context.Context, c OutputsConfig, wg *sync.WaitGroup) []Sink {
+	var sinks []Sink
+	if c.Pushgateway != nil {
+		sinks = append(sinks, NewPushgatewaySink(*c.Pushgateway))
+	}
+	if c.RemoteWrite != nil {
+		s := NewRemoteWriteSink(*c.RemoteWrite)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx)
+		}()
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
+
+// gathererFunc turns already gathered metric families into a gatherer.
+type gathererFunc func() ([]*dto.MetricFamily, error)
+
+func (f gathererFunc) Gather() ([]*dto.MetricFamily, error) {
+	return f()
+}
+
+// PushgatewaySink pushes the metrics of each query to a Pushgateway,
+// replacing the previous metrics of the query.
+type PushgatewaySink struct {
+	config PushgatewayConfig
+	client *http.Client
+}
+
+// NewPushgatewaySink creates a sink for the Pushgateway.
+func NewPushgatewaySink(c PushgatewayConfig) *PushgatewaySink {
+	if c.Job == "" {
+		c.Job = "prometheus-sql"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultOutputTimeout
+	}
+	return &PushgatewaySink{
+		config: c,
+		client: &http.Client{Timeout: c.Timeout},
+	}
+}
+
+// Push replaces the metrics of the query on the Pushgateway.
+func (s *PushgatewaySink) Push(q *Query, families []*dto.MetricFamily) error {
+	err := push.New(s.config.URL, s.config.Job).
+		Gatherer(gathererFunc(func() ([]*dto.MetricFamily, error) { return families, nil })).
+		Grouping("query", q.Name).
+		Grouping("data_source", q.DataSourceRef).
+		Client(s.client).
+		Push()
+	if err != nil {
+		return fmt.Errorf("Error pushing to pushgateway: %s", err)
+	}
+	return nil
+}
+
+type sample struct {
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp int64
+}
+
+// RemoteWriteSink sends the metrics of all queries in batches to a
+// Prometheus remote write endpoint.
+type RemoteWriteSink struct {
+	config  RemoteWriteConfig
+	client  *http.Client
+	samples chan sample
+	backoff backoff.Backoff
+}
+
+// NewRemoteWriteSink creates a sink for a remote write endpoint. Run must
+// be called to send the samples.
+func NewRemoteWriteSink(c RemoteWriteConfig) *RemoteWriteSink {
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultRemoteWriteBatchSize
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = DefaultRemoteWriteFlushInterval
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = DefaultRemoteWriteMaxRetries
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultOutputTimeout
+	}
+	return &RemoteWriteSink{
+		config:  c,
+		client:  &http.Client{Timeout: c.Timeout},
+		samples: make(chan sample, c.BatchSize*10),
+		backoff: backoff.Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second, Factor: 2, Jitter: true},
+	}
+}
+
+// Push queues the samples of the query. Samples are dropped if the queue
+// is full.
+func (s *RemoteWriteSink) Push(q *Query, families []*dto.MetricFamily) error {
+	ts := time.Now().UnixNano() / int64(time.Millisecond)
+	dropped := 0
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			labels := []*dto.LabelPair{{Name: stringPtr("__name__"), Value: mf.Name}}
+			labels = append(labels, m.Label...)
+			select {
+			case s.samples <- sample{labels: labels, value: sampleValue(m), timestamp: ts}:
+			default:
+				dropped++
+			}
+		}
+	}
+	if dropped > 0 {
+		remoteWriteSamples.WithLabelValues("dropped").Add(float64(dropped))
+		return fmt.Errorf("Remote write queue is full, dropped %d samples", dropped)
+	}
+	return nil
+}
+
+// Run sends the queued samples whenever a batch is full or the flush
+// interval has passed, until the context is done.
+func (s *RemoteWriteSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]sample, 0, s.config.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.send(ctx, batch); err != nil {
+			level.Error(logger).Log("msg", "Error sending samples to remote write endpoint", "samples", len(batch), "err", err)
+			remoteWriteSamples.WithLabelValues("failed").Add(float64(len(batch)))
+		} else {
+			remoteWriteSamples.WithLabelValues("sent").Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case smp := <-s.samples:
+			batch = append(batch, smp)
+			if len(batch) >= s.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			// Send what has been queued so far.
+			for len(s.samples) > 0 {
+				batch = append(batch, <-s.samples)
+				if len(batch) >= s.config.BatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// recoverableError is returned for failed requests which can be retried.
+type recoverableError struct {
+	error
+}
+
+// send encodes the samples and posts them, retrying on recoverable errors.
+func (s *RemoteWriteSink) send(ctx context.Context, samples []sample) error {
+	body := snappy.Encode(nil, encodeWriteRequest(samples, s.config.Labels))
+
+	b := s.backoff
+	var err error
+	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(b.Duration()):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		err = s.post(body)
+		if _, ok := err.(recoverableError); !ok {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *RemoteWriteSink) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("%s: %s", resp.Status, string(b))
+	// Server errors and rate limiting can be retried, other errors can't.
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// encodeWriteRequest encodes the samples as a remote write WriteRequest
+// protobuf message, one time series per sample.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []sample, extraLabels map[string]string) []byte {
+	var req []byte
+	for _, smp := range samples {
+		labels := make(map[string]string, len(smp.labels)+len(extraLabels))
+		for k, v := range extraLabels {
+			labels[k] = v
+		}
+		for _, l := range smp.labels {
+			labels[l.GetName()] = l.GetValue()
+		}
+		// Labels must be sorted by name.
+		names := make([]string, 0, len(labels))
+		for k := range labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		var ts []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, labels[name])
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(smp.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(smp.timestamp))
+
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, s)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// sampleValue returns the value of a gauge or counter.
+func sampleValue(m *dto.Metric) float64 {
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.GetGauge().GetValue()
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testFamilies(t *testing.T, name string) *QueryResult {
+	r := NewQueryResult(&Query{Name: name, DataField: "value", DataSourceRef: "my-ds"})
+	if err := r.SetMetrics(records{{"name": "foo", "value": 42}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestPushgatewaySink(t *testing.T) {
+	var method, path, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	r := testFamilies(t, "pushgateway_metric")
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPushgatewaySink(PushgatewayConfig{URL: ts.URL}).Push(r.Query, families); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != "PUT" {
+		t.Errorf("Method = %s, want PUT", method)
+	}
+	// The order of the grouping labels is not defined.
+	if !strings.HasPrefix(path, "/metrics/job/prometheus-sql/") ||
+		!strings.Contains(path, "/query/pushgateway_metric") ||
+		!strings.Contains(path, "/data_source/my-ds") {
+		t.Errorf("Path = %s, want job, query and data source grouping", path)
+	}
+	if len(body) == 0 {
+		t.Error("Empty body pushed")
+	}
+}
+
+// decodeLabels returns the label names and values of all time series in a
+// WriteRequest.
+func decodeLabels(t *testing.T, b []byte) map[string]string {
+	labels := make(map[string]string)
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		ts, m := protowire.ConsumeBytes(b[n:])
+		b = b[n+m:]
+		for len(ts) > 0 {
+			num, _, n := protowire.ConsumeTag(ts)
+			field, m := protowire.ConsumeBytes(ts[n:])
+			ts = ts[n+m:]
+			if num != 1 {
+				continue
+			}
+			_, _, n = protowire.ConsumeTag(field)
+			name, m := protowire.ConsumeString(field[n:])
+			field = field[n+m:]
+			_, _, n = protowire.ConsumeTag(field)
+			value, _ := protowire.ConsumeString(field[n:])
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	requests := make(chan []byte, 1)
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first request fails and is retried.
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("Content-Encoding = %s, want snappy", r.Header.Get("Content-Encoding"))
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- b
+	}))
+	defer ts.Close()
+
+	s := NewRemoteWriteSink(RemoteWriteConfig{
+		URL:           ts.URL,
+		Labels:        map[string]string{"instance": "batch-host"},
+		FlushInterval: 10 * time.Millisecond,
+	})
+	s.backoff.Min = time.Millisecond
+	s.backoff.Max = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	r := testFamilies(t, "remote_write_metric")
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Push(r.Query, families); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-requests:
+		req, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		labels := decodeLabels(t, req)
+		want := map[string]string{"__name__": "query_result_remote_write_metric", "name": "foo", "instance": "batch-host"}
+		for k, v := range want {
+			if labels[k] != v {
+				t.Errorf("Label %s = %q, want %q (labels: %v)", k, labels[k], v, labels)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No samples were sent")
+	}
+}
+
+func Test_validateOutputs(t *testing.T) {
+	err := validateOutputs(OutputsConfig{RemoteWrite: &RemoteWriteConfig{}})
+	if err == nil || !strings.Contains(err.Error(), "URL") {
+		t.Errorf("Expected error for missing URL, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SQLFileExt is the extension of the SQL files loaded from the queries
+// directory.
+const SQLFileExt = ".sql"
+
+// Delimiters of the front matter of SQL files, which tell it apart from
+// other comments.
+const (
+	frontMatterStart = "/*---"
+	frontMatterEnd   = "---*/"
+)
+
+// readSQLFile sets the SQL statement of a query with sql-file to the content
+// of the file. Relative paths are relative to dir, the directory of the file
+// the query is defined in.
+func readSQLFile(q *Query, dir string) error {
+	if q.SQLFile == "" {
+		return nil
+	}
+	if q.SQL != "" {
+		return fmt.Errorf("Either sql or sql-file can be specified for [%s]", q.Name)
+	}
+
+	path := q.SQLFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading SQL file of [%s]: %s", q.Name, err)
+	}
+	q.SQL = strings.TrimSpace(string(b))
+	return nil
+}
+
+// decodeSQLQuery decodes a SQL file starting with a front matter comment
+// which defines the query in YAML, e.g.
+//
+//	/*---
+//	interval: 1h
+//	data-source: sales
+//	---*/
+//	select count(1) from orders
+//
+// The query is named after the file unless the front matter sets a name.
+func decodeSQLQuery(r io.Reader, name string, config *Config) (QueryList, error) {
+	if config == nil {
+		return nil, errors.New("Bug! Config must not be nil")
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	front, sql, err := splitFrontMatter(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SQL file [%s]: %s", name, err)
+	}
+
+	q := &Query{}
+	if err := yaml.Unmarshal(front, q); err != nil {
+		return nil, fmt.Errorf("Error decoding front matter of SQL file [%s]: %s", name, err)
+	}
+	if q.Name == "" {
+		q.Name = name
+	}
+	if q.SQL != "" || q.SQLFile != "" {
+		return nil, fmt.Errorf("SQL must not be defined in the front matter of SQL file [%s]", name)
+	}
+	q.SQL = sql
+
+	queries, err := prepareQuery(q, "", config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateDependencies(queries, true); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+// hasFrontMatter returns whether the SQL file starts with a front matter
+// comment. Files starting with other comments have none.
+func hasFrontMatter(fn string) (bool, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false, fmt.Errorf("Error reading SQL file: %s", err)
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte(frontMatterStart)), nil
+}
+
+// splitFrontMatter splits a SQL file into the content of its front matter
+// comment and the SQL statement.
+func splitFrontMatter(b []byte) ([]byte, string, error) {
+	b = bytes.TrimSpace(b)
+	if !bytes.HasPrefix(b, []byte(frontMatterStart)) {
+		return nil, "", errors.New("Front matter comment missing")
+	}
+	b = b[len(frontMatterStart):]
+	end := bytes.Index(b, []byte(frontMatterEnd))
+	if end < 0 {
+		return nil, "", errors.New("Front matter comment not closed")
+	}
+	return b[:end], string(bytes.TrimSpace(b[end+len(frontMatterEnd):])), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SQLTimeFormat is the format of times rendered with sqltime.
+const SQLTimeFormat = "2006-01-02 15:04:05"
+
+// templateFuncs are the helpers available in the sql and params templates.
+var templateFuncs = template.FuncMap{
+	// Value of an environment variable.
+	"env": os.Getenv,
+	// Time minus a duration, e.g. sub .Now .Interval.
+	"sub": func(t time.Time, d time.Duration) time.Time {
+		return t.Add(-d)
+	},
+	// Time in UTC formatted for SQL.
+	"sqltime": func(t time.Time) string {
+		return t.UTC().Format(SQLTimeFormat)
+	},
+}
+
+// templateData is available in the sql and params templates of a query.
+type templateData struct {
+	Name     string
+	Labels   map[string]string
+	Interval time.Duration
+	Now      time.Time
+	// Start of the last successful execution. Before the first success it
+	// is one interval before now.
+	LastSuccess time.Time
+}
+
+// queryTemplate renders the SQL statement and the parameters of a query with
+// template enabled for each execution. Values without template actions and
+// the values of other queries are used as they are.
+type queryTemplate struct {
+	query  *Query
+	sql    *template.Template
+	params map[string]*template.Template
+	// Environment variables read by the last render, so their values can
+	// be masked in the logs.
+	env map[string]interface{}
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func parseQueryTemplate(q *Query) (*queryTemplate, error) {
+	t := &queryTemplate{query: q, params: make(map[string]*template.Template)}
+	if q.Template == nil || !*q.Template {
+		return t, nil
+	}
+
+	sql, err := parseTemplate("sql", q.SQL)
+	if err != nil {
+		return nil, err
+	}
+	t.sql = sql
+	for k, v := range q.Params {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		p, err := parseTemplate(k, s)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			t.params[k] = p
+		}
+	}
+	return t, nil
+}
+
+func execute(t *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// render returns the SQL statement and the parameters for an execution.
+func (t *queryTemplate) render(now, lastSuccess time.Time) (string, map[string]interface{}, error) {
+	if lastSuccess.IsZero() {
+		lastSuccess = now.Add(-t.query.Interval)
+	}
+	t.env = make(map[string]interface{})
+	funcs := template.FuncMap{"env": func(name string) string {
+		v := os.Getenv(name)
+		t.env[name] = v
+		return v
+	}}
+
+	data := templateData{
+		Name:        t.query.metricName(),
+		Labels:      t.query.Labels,
+		Interval:    t.query.Interval,
+		Now:         now,
+		LastSuccess: lastSuccess,
+	}
+
+	sql := t.query.SQL
+	if t.sql != nil {
+		var err error
+		if sql, err = execute(t.sql.Funcs(funcs), data); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if len(t.params) == 0 {
+		return sql, t.query.Params, nil
+	}
+	params := make(map[string]interface{}, len(t.query.Params))
+	for k, v := range t.query.Params {
+		if p, ok := t.params[k]; ok {
+			s, err := execute(p.Funcs(funcs), data)
+			if err != nil {
+				return "", nil, err
+			}
+			v = s
+		}
+		params[k] = v
+	}
+	return sql, params, nil
+}
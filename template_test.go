@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestQueryTemplate(t *testing.T) {
+	os.Setenv("PROMETHEUS_SQL_TEST_SCHEMA", "sales")
+	defer os.Unsetenv("PROMETHEUS_SQL_TEST_SCHEMA")
+
+	enabled := true
+	q := &Query{
+		Name:     "orders",
+		Template: &enabled,
+		Interval: time.Hour,
+		SQL:      `select count(*) from {{ env "PROMETHEUS_SQL_TEST_SCHEMA" }}.orders where created > '{{ sqltime .LastSuccess }}' -- {{ .Name }}`,
+		Params: map[string]interface{}{
+			"since": "{{ sqltime (sub .Now .Interval) }}",
+			"limit": 10,
+			"kind":  "web",
+		},
+	}
+	tmpl, err := parseQueryTemplate(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	sql, params, err := tmpl.render(now, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `select count(*) from sales.orders where created > '2020-01-02 14:04:05' -- orders`; sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+	want := map[string]interface{}{"since": "2020-01-02 14:04:05", "limit": 10, "kind": "web"}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %v, want %v", k, params[k], v)
+		}
+	}
+	if q.Params["since"] == params["since"] {
+		t.Error("Params of the query were modified")
+	}
+
+	// The last successful run is used once there is one.
+	sql, _, err = tmpl.render(now, now.Add(-10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `select count(*) from sales.orders where created > '2020-01-02 14:54:05' -- orders`; sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+
+	if _, err := parseQueryTemplate(&Query{SQL: "select {{ .Name ", Template: &enabled}); err == nil {
+		t.Error("Expected error for invalid template")
+	}
+
+	// Queries without template are used as they are.
+	q = &Query{
+		Name:     "tags",
+		Interval: time.Hour,
+		SQL:      `select count(1) from tags where doc @> '{"a": {{1}}}'`,
+		Params:   map[string]interface{}{"doc": "{{ .Name }}"},
+	}
+	tmpl, err = parseQueryTemplate(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, params, err = tmpl.render(now, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != q.SQL || params["doc"] != "{{ .Name }}" {
+		t.Errorf("sql = %s, params = %v", sql, params)
+	}
+}
+
+func TestRenderedEnvRedacted(t *testing.T) {
+	os.Setenv("PROMETHEUS_SQL_TEST_PASSWORD", "env-s3cret")
+	defer os.Unsetenv("PROMETHEUS_SQL_TEST_PASSWORD")
+	os.Setenv("PROMETHEUS_SQL_TEST_TABLE", "orders")
+	defer os.Unsetenv("PROMETHEUS_SQL_TEST_TABLE")
+
+	enabled := true
+	q := &Query{
+		Name:     "env_metric",
+		Template: &enabled,
+		Interval: time.Hour,
+		SQL:      `select count(1) from {{ env "PROMETHEUS_SQL_TEST_TABLE" }} where key = '{{ env "PROMETHEUS_SQL_TEST_PASSWORD" }}'`,
+	}
+	w := NewWorker(context.Background(), q, &WorkerShared{Deps: NewDependencies()})
+	if _, err := w.encodePayload(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "select count(1) from orders where key = '<redacted>'"
+	if got := redactor.String("select count(1) from orders where key = 'env-s3cret'"); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
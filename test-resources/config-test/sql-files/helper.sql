@@ -0,0 +1,2 @@
+/* Helper used by the reports */
+select 1
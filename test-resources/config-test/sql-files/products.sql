@@ -0,0 +1,8 @@
+/*---
+driver: mysql
+interval: 1h
+data-field: cnt
+---*/
+select category, count(1) as cnt
+from products
+group by category
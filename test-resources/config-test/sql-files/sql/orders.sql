@@ -0,0 +1,3 @@
+/* Orders of all tenants */
+select count(1)
+from orders
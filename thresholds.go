@@ -0,0 +1,58 @@
+package main
+
+// Values of the status metric of a query with thresholds.
+const (
+	thresholdOK       = 0
+	thresholdWarning  = 1
+	thresholdCritical = 2
+)
+
+// statusSuffix is appended to the metric name of the status metrics.
+const statusSuffix = "status"
+
+func validOperator(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// Exceeded reports whether v is beyond the threshold. A nil threshold is
+// never exceeded.
+func (t *Threshold) Exceeded(v float64) bool {
+	if t == nil {
+		return false
+	}
+	switch t.Operator {
+	case ">":
+		return v > t.Value
+	case ">=":
+		return v >= t.Value
+	case "<":
+		return v < t.Value
+	case "<=":
+		return v <= t.Value
+	case "==":
+		return v == t.Value
+	case "!=":
+		return v != t.Value
+	}
+	return false
+}
+
+// Defined reports whether any threshold is set.
+func (t Thresholds) Defined() bool {
+	return t.Warning != nil || t.Critical != nil
+}
+
+// Status returns the status metric value for a result.
+func (t Thresholds) Status(v float64) float64 {
+	switch {
+	case t.Critical.Exceeded(v):
+		return thresholdCritical
+	case t.Warning.Exceeded(v):
+		return thresholdWarning
+	}
+	return thresholdOK
+}
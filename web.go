@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/tylerb/graceful.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// WebConfig secures the endpoints served by prometheus-sql. The format
+// follows the web configuration file of the Prometheus exporter-toolkit.
+type WebConfig struct {
+	TLSServerConfig *TLSServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSServerConfig defines the certificate of the server and how clients
+// are authenticated. Files are read again when they change.
+type TLSServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+func loadWebConfig(file string) (*WebConfig, error) {
+	level.Info(logger).Log("msg", "Loading web config", "file", file)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading web config file: %s", err)
+	}
+
+	var c WebConfig
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("Error decoding web config file: %s", err)
+	}
+	if err := validateWebConfig(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func validateWebConfig(c *WebConfig) error {
+	if t := c.TLSServerConfig; t != nil {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return errors.New("Both cert_file and key_file must be set in tls_server_config")
+		}
+		if t.ClientAuthType != "" {
+			if _, ok := clientAuthTypes[t.ClientAuthType]; !ok {
+				return fmt.Errorf("Invalid client_auth_type [%s]", t.ClientAuthType)
+			}
+		}
+		if t.ClientCAFile == "" && t.ClientAuthType != "" && clientAuthTypes[t.ClientAuthType] > tls.RequireAnyClientCert {
+			return errors.New("client_ca_file must be set to verify client certificates")
+		}
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("Invalid bcrypt hash for user [%s]: %s", user, err)
+		}
+	}
+	return nil
+}
+
+// tlsReloader builds the TLS config of the server, reading the certificate
+// files again once they have been modified.
+type tlsReloader struct {
+	config *TLSServerConfig
+
+	mu      sync.Mutex
+	modTime map[string]time.Time
+	tls     *tls.Config
+}
+
+func (r *tlsReloader) changed() bool {
+	for _, f := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(r.modTime[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	modTime := make(map[string]time.Time)
+	for _, f := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTime[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading server certificate: %s", err)
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.config.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading client CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in client CA file [%s]", r.config.ClientCAFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if r.config.ClientAuthType != "" {
+		tc.ClientAuth = clientAuthTypes[r.config.ClientAuthType]
+	}
+
+	r.modTime = modTime
+	r.tls = tc
+	return tc, nil
+}
+
+// getConfig returns the current TLS config. If reloading modified files
+// fails, the previous config is kept.
+func (r *tlsReloader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tls == nil || r.changed() {
+		if _, err := r.load(); err != nil {
+			level.Error(logger).Log("msg", "Error reloading TLS config", "err", err)
+			if r.tls == nil {
+				return nil, err
+			}
+		}
+	}
+	return r.tls, nil
+}
+
+// basicAuthHandler requires the requests to be authenticated by one of
+// the users.
+func basicAuthHandler(users map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if ok {
+			if hash, found := users[user]; found && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="prometheus-sql"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// serveWeb serves the handler on addr until the process is interrupted,
+// secured by the web config if given.
+func serveWeb(addr string, handler http.Handler, c *WebConfig) error {
+	if c != nil && len(c.BasicAuthUsers) > 0 {
+		handler = basicAuthHandler(c.BasicAuthUsers, handler)
+	}
+
+	srv := &graceful.Server{
+		Timeout:      5 * time.Second,
+		TCPKeepAlive: 3 * time.Minute,
+		Server:       &http.Server{Addr: addr, Handler: handler},
+	}
+
+	var err error
+	if c != nil && c.TLSServerConfig != nil {
+		r := &tlsReloader{config: c.TLSServerConfig}
+		// Fail on startup if the certificate can't be loaded.
+		if _, err := r.getConfig(nil); err != nil {
+			return err
+		}
+		err = srv.ListenAndServeTLSConfig(&tls.Config{GetConfigForClient: r.getConfig})
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	// Errors while accepting connections are returned when stopping.
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
+		return nil
+	}
+	return err
+}
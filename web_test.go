@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &WebConfig{BasicAuthUsers: map[string]string{"prometheus": string(hash)}}
+	if err := validateWebConfig(c); err != nil {
+		t.Fatal(err)
+	}
+
+	h := basicAuthHandler(c.BasicAuthUsers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		user, pass string
+		want       int
+	}{
+		{"prometheus", "s3cr3t", http.StatusOK},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"unknown", "s3cr3t", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("[%s:%s] status = %d, want %d", tt.user, tt.pass, rec.Code, tt.want)
+		}
+	}
+}
+
+func Test_validateWebConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		c    WebConfig
+	}{
+		{"missing-key", WebConfig{TLSServerConfig: &TLSServerConfig{CertFile: "cert.pem"}}},
+		{"bad-client-auth-type", WebConfig{TLSServerConfig: &TLSServerConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientAuthType: "Always"}}},
+		{"verify-without-ca", WebConfig{TLSServerConfig: &TLSServerConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientAuthType: "RequireAndVerifyClientCert"}}},
+		{"plain-password", WebConfig{BasicAuthUsers: map[string]string{"prometheus": "s3cr3t"}}},
+	}
+	for _, tt := range tests {
+		if err := validateWebConfig(&tt.c); err == nil {
+			t.Errorf("[%s] expected error", tt.name)
+		}
+	}
+}
@@ -6,19 +6,22 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 )
 
 // Backoff for fetching. It starts by waiting the minimum duration after a
 // failed fetch, doubling it each time (with a bitter of jitter) up to max
-// duration between requests.
+// duration between requests. Values not configured for a query are taken
+// from here.
 var defaultBackoff = backoff.Backoff{
 	Min:    1 * time.Second,
 	Max:    5 * time.Minute,
@@ -26,21 +29,66 @@ var defaultBackoff = backoff.Backoff{
 	Factor: 2,
 }
 
+func newBackoff(c BackoffConfig) backoff.Backoff {
+	b := defaultBackoff
+	if c.Min != 0 {
+		b.Min = c.Min
+	}
+	if c.Max != 0 {
+		b.Max = c.Max
+	}
+	if c.Factor != 0 {
+		b.Factor = c.Factor
+	}
+	if c.Jitter != nil {
+		b.Jitter = *c.Jitter
+	}
+	return b
+}
+
+// WorkerShared is the state shared by all workers.
+type WorkerShared struct {
+	Limiter   *QueryLimiter
+	Breakers  map[string]*CircuitBreaker
+	Deps      *Dependencies
+	Transport http.RoundTripper
+	Services  *ServicePool
+	Format    string
+	Series    *SeriesBudget
+	Registry  *prometheus.Registry
+	Results   *resultIndex
+	Sinks     []Sink
+	Secrets   *Secrets
+}
+
 // Worker is responsible for fetching data via SQL Agent
 type Worker struct {
-	query   *Query
-	payload []byte
-	client  *http.Client
-	result  *QueryResult
-	log     *log.Logger
-	backoff backoff.Backoff
-	ctx     context.Context
+	query      *Query
+	client     *http.Client
+	result     *QueryResult
+	log        log.Logger
+	backoff    backoff.Backoff
+	maxRetries int
+	// Failed queries are not retried, e.g. in one-shot mode.
+	noRetries bool
+	limiter   *QueryLimiter
+	breaker   *CircuitBreaker
+	deps      *Dependencies
+	seenDeps  map[string]int
+	services  *ServicePool
+	accept    string
+	sinks     []Sink
+	secrets   *Secrets
+	template  *queryTemplate
+	// Start of the last successful execution.
+	lastSuccess time.Time
+	ctx         context.Context
 }
 
 func (w *Worker) setQueryResultMetrics(recs records) {
 	err := w.result.SetMetrics(recs, w.query.ValueOnError)
 	if err != nil {
-		w.log.Printf("Error setting metrics: %s", err)
+		level.Error(w.log).Log("msg", "Error setting metrics", "err", err)
 		return
 	}
 }
@@ -49,48 +97,188 @@ func (w *Worker) queryResultError() {
 	w.setQueryResultMetrics(nil)
 }
 
-func (w *Worker) fetchRecords(url string) error {
-	var (
-		t    time.Time
-		err  error
-		req  *http.Request
-		resp *http.Response
-	)
+// encodePayload encodes the request body of the query. The payload is
+// encoded for each execution to use the current values of the secrets and
+// to render the SQL statement and parameters.
+func (w *Worker) encodePayload(now time.Time) ([]byte, error) {
+	connection, err := w.secrets.Resolve(w.query.Connection)
+	if err != nil {
+		return nil, err
+	}
+	redactor.SetValues(w.query.Name, connection)
 
-	for {
-		t = time.Now()
+	sql, params, err := w.template.render(now, w.lastSuccess)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering template: %s", err)
+	}
+	// Sensitive environment variables are masked like connection values.
+	redactor.SetValues("env:"+w.query.Name, w.template.env)
+	level.Debug(w.log).Log("msg", "Rendered SQL", "sql", sql)
 
-		req, err = http.NewRequest("POST", url, bytes.NewBuffer(w.payload))
+	return json.Marshal(map[string]interface{}{
+		"driver":     w.query.Driver,
+		"connection": connection,
+		"sql":        sql,
+		"params":     params,
+	})
+}
 
-		if err != nil {
-			panic(err)
-		}
-		req = req.WithContext(w.ctx)
+// post sends the query to a single SQL agent service.
+func (w *Worker) post(url string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		panic(err)
+	}
+	req = req.WithContext(w.ctx)
+
+	// Set the content-type of the request body and the accepted format.
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("accept", w.accept)
 
-		// Set the content-type of the request body and accept LD-JSON.
-		req.Header.Set("content-type", "application/json")
-		req.Header.Set("accept", "application/json")
+	return w.client.Do(req)
+}
 
-		resp, err = w.client.Do(req)
+// request sends the query to the services of its data source in order until
+// one of them is available.
+func (w *Worker) request(payload []byte) (*http.Response, error) {
+	var err error
+	for _, e := range w.services.Select(w.query.DataSourceRef) {
+		var resp *http.Response
+		resp, err = w.post(e.URL, payload)
+
+		// The service is not reachable, try the next one.
+		if err != nil || isUnavailable(resp.StatusCode) {
+			if err == nil {
+				resp.Body.Close()
+				err = fmt.Errorf("%s: %s", e.Name, resp.Status)
+			}
+			if w.ctx.Err() != nil {
+				return nil, err
+			}
+			w.services.Report(e, err)
+			continue
+		}
+		w.services.Report(e, nil)
 
 		// No formal error, but a non-successful status code. Construct an error.
-		if err == nil && resp.StatusCode != 200 {
+		if resp.StatusCode != 200 {
 			b, _ := ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
-			err = fmt.Errorf("%s: %s", resp.Status, string(b))
+			return nil, &statusError{
+				status: resp.StatusCode,
+				msg:    fmt.Sprintf("%s: %s", resp.Status, string(b)),
+			}
+		}
+		return resp, nil
+	}
+	if err == nil {
+		err = errors.New("No SQL agent service available")
+	}
+	return nil, err
+}
+
+// statusError is returned for responses of the SQL agent with an error
+// status.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// isDataSourceError returns whether the error indicates that the data
+// source is not available. Client errors of the SQL agent, such as invalid
+// SQL statements, are caused by the query itself.
+func isDataSourceError(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status >= 500
+	}
+	return true
+}
+
+func isUnavailable(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+func (w *Worker) fetchRecords() error {
+	var (
+		t       time.Time
+		err     error
+		resp    *http.Response
+		release func()
+		retries int
+	)
+
+	start := time.Now()
+	payload, err := w.encodePayload(start)
+	if err != nil {
+		w.queryResultError()
+		return err
+	}
+
+	// Retries stop at the next scheduled execution so a failing query
+	// doesn't delay its own schedule.
+	deadline := time.Now().Add(w.query.Interval)
+	defer w.backoff.Reset()
+
+	for {
+		// Skip the query while the data source is considered down.
+		if !w.breaker.Allow() {
+			w.queryResultError()
+			return errCircuitOpen
 		}
 
+		release, err = w.limiter.Acquire(w.ctx, w.query)
+		if err != nil {
+			w.breaker.Release()
+			return errors.New("Execution was canceled")
+		}
+
+		t = time.Now()
+
+		resp, err = w.request(payload)
+
 		// No error, break to read the data.
 		if err == nil {
+			defer release()
+			w.breaker.Success()
 			break
 		}
-		w.log.Print(err)
+		release()
+		if w.ctx.Err() != nil {
+			w.breaker.Release()
+			return errors.New("Execution was canceled")
+		}
+		// Only errors indicating that the data source is not available
+		// count, a broken query must not skip the other queries.
+		if isDataSourceError(err) {
+			w.breaker.Failure()
+		} else {
+			w.breaker.Release()
+		}
+		level.Warn(w.log).Log("msg", "Query failed", "err", err)
 
 		w.queryResultError()
 
+		if w.noRetries {
+			return err
+		}
+		if w.maxRetries > 0 && retries >= w.maxRetries {
+			return fmt.Errorf("Giving up after %d retries", retries)
+		}
+		retries++
+
 		// Backoff on an error.
 		d := w.backoff.Duration()
-		w.log.Printf("Backing off for %s", d)
+		if time.Now().Add(d).After(deadline) {
+			return errors.New("Giving up until next scheduled execution")
+		}
+		level.Info(w.log).Log("msg", "Backing off", "duration", d)
 		select {
 		case <-time.After(d):
 			continue
@@ -99,29 +287,85 @@ func (w *Worker) fetchRecords(url string) error {
 		}
 	}
 
-	w.backoff.Reset()
-
-	w.log.Printf("Fetch took %s", time.Now().Sub(t))
-
-	var recs []record
+	level.Info(w.log).Log("msg", "Fetched records", "duration", time.Since(t))
 
 	defer resp.Body.Close()
 
-	if err = json.NewDecoder(resp.Body).Decode(&recs); err != nil {
+	// Records are decoded one at a time to keep large result sets out of
+	// memory.
+	next, err := decodeRecords(resp.Body, resp.Header.Get("content-type"))
+	if err != nil {
 		return err
 	}
 
-	w.setQueryResultMetrics(recs)
+	// On errors the previous metrics are kept.
+	if err = w.result.SetMetricsFrom(limitRecords(next, w.query.MaxRows), w.query.ValueOnError); err != nil {
+		return fmt.Errorf("Error setting metrics: %s", err)
+	}
+
+	w.lastSuccess = start
+	w.pushResults()
 
 	return nil
 }
 
-// Start fetching data from specified URL
-func (w *Worker) Start(url string, wg *sync.WaitGroup) {
-	tick := func() {
-		err := w.fetchRecords(url)
+// pushResults sends the metrics of the query to the sinks. Errors are only
+// logged since the metrics are still served by the metrics endpoint.
+func (w *Worker) pushResults() {
+	if len(w.sinks) == 0 {
+		return
+	}
+	families, err := w.result.Gather()
+	if err != nil {
+		level.Error(w.log).Log("msg", "Error gathering metrics", "err", err)
+		return
+	}
+	for _, s := range w.sinks {
+		if err := s.Push(w.query, families); err != nil {
+			level.Error(w.log).Log("msg", "Error pushing metrics", "err", err)
+		}
+	}
+}
+
+// Run executes the query once. Dependent queries only run after their
+// dependencies succeeded.
+func (w *Worker) Run() error {
+	if len(w.query.DependsOn) > 0 {
+		err := w.deps.Wait(w.ctx, w.query.DependsOn, w.seenDeps, time.Now().Add(w.query.Interval))
 		if err != nil {
-			w.log.Printf("Error fetching records: %s", err)
+			queryDependencyFailed.WithLabelValues(w.query.Name).Set(1)
+			w.queryResultError()
+			w.deps.Done(w.query.Name, false)
+			return fmt.Errorf("Skipping execution: %s", err)
+		}
+		queryDependencyFailed.WithLabelValues(w.query.Name).Set(0)
+	}
+
+	err := w.fetchRecords()
+	w.deps.Done(w.query.Name, err == nil)
+	return err
+}
+
+// Start fetching data from the SQL agent services
+func (w *Worker) Start(wg *sync.WaitGroup) {
+	tick := func() {
+		err := w.Run()
+		// The circuit breaker logs its own state changes.
+		if err != nil && err != errCircuitOpen {
+			level.Error(w.log).Log("msg", "Error fetching records", "err", err)
+			return
+		}
+	}
+
+	// Spread the first execution of the queries so they don't all hit the
+	// databases at the same time on startup.
+	if d := w.startDelay(); d > 0 {
+		level.Info(w.log).Log("msg", "Delaying first execution", "duration", d)
+		select {
+		case <-time.After(d):
+		case <-w.ctx.Done():
+			wg.Done()
+			level.Info(w.log).Log("msg", "Stopping worker")
 			return
 		}
 	}
@@ -133,7 +377,7 @@ func (w *Worker) Start(url string, wg *sync.WaitGroup) {
 		select {
 		case <-w.ctx.Done():
 			wg.Done()
-			w.log.Printf("Stopping worker")
+			level.Info(w.log).Log("msg", "Stopping worker")
 			return
 
 		case <-ticker.C:
@@ -142,28 +386,63 @@ func (w *Worker) Start(url string, wg *sync.WaitGroup) {
 	}
 }
 
+// startDelay returns a random delay up to the start jitter of the query,
+// capped to its interval. Without a start jitter the first executions are
+// spread over the interval, a start jitter of zero disables the delay.
+func (w *Worker) startDelay() time.Duration {
+	max := w.query.Interval
+	if j := w.query.StartJitter; j != nil && *j < max {
+		max = *j
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
 // NewWorker creates a new worker for a query.
-func NewWorker(ctx context.Context, q *Query) *Worker {
-	// Encode the payload once for all subsequent requests.
-	payload, err := json.Marshal(map[string]interface{}{
-		"driver":     q.Driver,
-		"connection": q.Connection,
-		"sql":        q.SQL,
-		"params":     q.Params,
-	})
+func NewWorker(ctx context.Context, q *Query, shared *WorkerShared) *Worker {
+	accept, ok := formatMediaTypes[shared.Format]
+	if !ok {
+		accept = formatMediaTypes[FormatJSON]
+	}
+
+	maxRetries := 0
+	if q.Backoff.MaxRetries != nil {
+		maxRetries = *q.Backoff.MaxRetries
+	}
 
+	// Templates are checked when the queries are loaded.
+	tmpl, err := parseQueryTemplate(q)
 	if err != nil {
 		panic(err)
 	}
 
+	result := NewQueryResult(q)
+	result.Budget = shared.Series
+	result.Registry = shared.Registry
+	if shared.Results != nil {
+		shared.Results.add(result)
+	}
+
 	return &Worker{
-		query:   q,
-		result:  NewQueryResult(q),
-		payload: payload,
-		backoff: defaultBackoff,
-		log:     log.New(os.Stderr, fmt.Sprintf("[%s] ", q.Name), log.LstdFlags),
+		query:      q,
+		result:     result,
+		backoff:    newBackoff(q.Backoff),
+		maxRetries: maxRetries,
+		limiter:    shared.Limiter,
+		breaker:    shared.Breakers[q.DataSourceRef],
+		deps:       shared.Deps,
+		services:   shared.Services,
+		accept:     accept,
+		sinks:      shared.Sinks,
+		secrets:    shared.Secrets,
+		template:   tmpl,
+		seenDeps:   make(map[string]int),
+		log:        log.With(logger, "query", q.Name, "data_source", q.DataSourceRef),
 		client: &http.Client{
-			Timeout: q.Timeout,
+			Timeout:   q.Timeout,
+			Transport: shared.Transport,
 		},
 		ctx: ctx,
 	}
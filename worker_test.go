@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFetchRecordsRetries(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	two, unlimited := 2, 0
+	noJitter := false
+	c := newConfig()
+	c.DataSources = map[string]DataSource{
+		"retry-ds": {
+			Driver:     "mysql",
+			Properties: map[string]interface{}{"host": "localhost"},
+			Backoff:    BackoffConfig{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond, Jitter: &noJitter, MaxRetries: &two},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		backoff  BackoffConfig
+		min, max int32
+		err      string
+	}{
+		{
+			name:     "Max retries",
+			interval: time.Hour,
+			min:      3,
+			max:      3,
+			err:      "Giving up after 2 retries",
+		},
+		{
+			// Retries stop at the next scheduled execution.
+			name:     "Deadline",
+			interval: 100 * time.Millisecond,
+			backoff:  BackoffConfig{Min: 30 * time.Millisecond, Max: 30 * time.Millisecond, MaxRetries: &unlimited},
+			min:      2,
+			max:      4,
+			err:      "Giving up until next scheduled execution",
+		},
+		{
+			// Zero lifts the limit of the data source.
+			name:     "Unlimited",
+			interval: 200 * time.Millisecond,
+			backoff:  BackoffConfig{MaxRetries: &unlimited},
+			min:      4,
+			max:      20,
+			err:      "Giving up until next scheduled execution",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Query{Name: "retry_metric", DataSourceRef: "retry-ds", SQL: "select 1", Interval: tt.interval, Backoff: tt.backoff}
+			if err := applyQueryDefaults(q, c); err != nil {
+				t.Fatal(err)
+			}
+			w := NewWorker(context.Background(), q, &WorkerShared{
+				Limiter:  NewQueryLimiter(0, nil),
+				Deps:     NewDependencies(),
+				Services: NewServicePool(StrategyFailover, []ServiceEndpoint{{Name: "agent", URL: ts.URL}}, nil),
+			})
+
+			atomic.StoreInt32(&attempts, 0)
+			start := time.Now()
+			err := w.fetchRecords()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("fetchRecords() error = %v, want %s", err, tt.err)
+			}
+			if n := atomic.LoadInt32(&attempts); n < tt.min || n > tt.max {
+				t.Errorf("Attempts = %d, want %d to %d", n, tt.min, tt.max)
+			}
+			// The last attempt starts before the next scheduled execution.
+			if d := time.Since(start); d > tt.interval+50*time.Millisecond {
+				t.Errorf("fetchRecords() took %s, longer than the interval", d)
+			}
+		})
+	}
+}
+
+func TestStartDelay(t *testing.T) {
+	jitter, none := time.Second, time.Duration(0)
+	q := &Query{Name: "delay_metric", Interval: time.Minute, Timeout: DefaultTimeout}
+	w := NewWorker(context.Background(), q, &WorkerShared{Deps: NewDependencies()})
+
+	// Without a start jitter the first executions are spread over the
+	// interval.
+	var spread bool
+	for i := 0; i < 10; i++ {
+		d := w.startDelay()
+		if d < 0 || d >= q.Interval {
+			t.Fatalf("startDelay() = %s, want less than %s", d, q.Interval)
+		}
+		spread = spread || d > 0
+	}
+	if !spread {
+		t.Error("Expected a delay without a start jitter")
+	}
+
+	q.StartJitter = &jitter
+	for i := 0; i < 10; i++ {
+		if d := w.startDelay(); d < 0 || d >= jitter {
+			t.Fatalf("startDelay() = %s, want less than %s", d, jitter)
+		}
+	}
+
+	q.StartJitter = &none
+	if d := w.startDelay(); d != 0 {
+		t.Errorf("startDelay() = %s, want 0", d)
+	}
+}